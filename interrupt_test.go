@@ -0,0 +1,54 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInterruptForwardsSignal(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	mkfile := "out:\n" +
+		"\ttrap 'echo caught > caught; exit 1' TERM\n" +
+		"\techo partial > out\n" +
+		"\ttouch started\n" +
+		"\twhile :; do sleep 0.05; done\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "TEST_MAIN=mk")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(filepath.Join(dir, "started")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			t.Fatal("recipe didn't start")
+		}
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+
+	var exitErr *exec.ExitError
+	if err := cmd.Wait(); !errors.As(err, &exitErr) || exitErr.ExitCode() != 128+int(syscall.SIGTERM) {
+		t.Errorf("mk exited with %v, want status %d", err, 128+int(syscall.SIGTERM))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "caught")); err != nil {
+		t.Errorf("recipe didn't receive the signal: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out")); err == nil {
+		t.Errorf("interrupted target wasn't deleted")
+	}
+}
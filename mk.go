@@ -2,460 +2,186 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
-	"sync"
-	"sync/atomic"
-	"time"
+	"syscall"
 
 	"github.com/mattn/go-isatty"
+	"github.com/sgrankin/mk/mk"
 )
 
-var (
-	// True if messages should be printed with fancy colors.
-	// By default, if the output stream is not the terminal, colors are disabled.
-	color bool
-
-	// Default shell to use if none specified via $shell.
-	defaultShell string
-
-	// Do not drop shell arguments when calling with no further arguments
-	// This works around `sh -c commands...` being a thing, but allows the `rc -v commands...` argument-less flags
-	dontDropArgs bool
-
-	// Lock on standard out, messages don't get interleaved too much.
-	mkMsgMutex sync.Mutex
-
-	// sched controls parallel recipe execution.
-	sched scheduler
-
-	// The maximum number of times an rule may be applied.
-	// This limits recursion of both meta- and non-meta-rules!
-	// Maybe, this shouldn't affect meta-rules?!
-	maxRuleCnt int = 1
-
-	// Pretend this target was recently modified (-w flag).
-	pretendModified string
-)
-
-// scheduler controls parallel recipe execution, limiting the number of
-// concurrent subprocesses.
-type scheduler struct {
-	allowed   int
-	running   int
-	cond      *sync.Cond
-	exclusive sync.Mutex
-}
-
-// buildOpts holds build-mode configuration that is constant throughout a build.
-type buildOpts struct {
-	vars           map[string][]string
-	unexportedVars map[string]bool
-	dryrun         bool
-	keepgoing      bool
-	touchmode      bool
-	forceIntermed  bool
-	explain        bool
-	rebuildall     bool
-	rebuildTargets map[string]bool
-	failed         atomic.Bool
-}
-
-// Wait until there is an available subprocess slot.
-// Returns the 0-based slot number assigned to this job.
-func (s *scheduler) reserve() int {
-	s.cond.L.Lock()
-	for s.running >= s.allowed {
-		s.cond.Wait()
-	}
-	slot := s.running
-	s.running++
-	s.cond.L.Unlock()
-	return slot
-}
-
-// Free up another subprocess to run.
-func (s *scheduler) finish() {
-	s.cond.L.Lock()
-	s.running--
-	s.cond.Signal()
-	s.cond.L.Unlock()
-}
-
-// Acquire exclusive access, waiting for all running subprocesses to finish.
-func (s *scheduler) reserveExclusive() {
-	s.exclusive.Lock()
-	stolenSubprocs := 0
-	s.cond.L.Lock()
-	stolenSubprocs = s.allowed - s.running
-	s.running = s.allowed
-	for stolenSubprocs < s.allowed {
-		s.cond.Wait()
-		stolenSubprocs += s.allowed - s.running
-		s.running = s.allowed
-	}
-}
-
-func (s *scheduler) finishExclusive() {
-	s.running = 0
-	s.cond.Broadcast()
-	s.cond.L.Unlock()
-	s.exclusive.Unlock()
-}
-
 // Ansi color codes.
 const (
-	ansiTermDefault   = "\033[0m"
-	// ansiTermBlack   = "\033[30m"
-	ansiTermRed       = "\033[31m"
-	// ansiTermGreen  = "\033[32m"
-	// ansiTermYellow = "\033[33m"
-	ansiTermBlue      = "\033[34m"
-	// ansiTermMagenta = "\033[35m"
-	ansiTermBright    = "\033[1m"
-	ansiTermUnderline = "\033[4m"
+	ansiTermDefault = "\033[0m"
+	ansiTermRed     = "\033[31m"
 )
 
-// Build a node's prereqs. Block until completed.
-func mkNodePrereqs(g *graph, prereqs []*node, opts *buildOpts, required bool) nodeStatus {
-	// When limited to a single process, build sequentially to preserve order.
-	if sched.allowed == 1 {
-		status := nodeStatusDone
-		for i := range prereqs {
-			prereqs[i].mutex.Lock()
-			switch prereqs[i].status {
-			case nodeStatusReady, nodeStatusNop:
-				prereqs[i].mutex.Unlock()
-				mkNode(g, prereqs[i], opts, required)
-			default:
-				prereqs[i].mutex.Unlock()
-			}
-			prereqs[i].mutex.Lock()
-			s := prereqs[i].status
-			prereqs[i].mutex.Unlock()
-			if s == nodeStatusFailed {
-				status = nodeStatusFailed
-			}
-		}
-		return status
-	}
-
-	prereqstat := make(chan nodeStatus)
-	pending := 0
-
-	// build prereqs that need building
-	for i := range prereqs {
-		prereqs[i].mutex.Lock()
-		switch prereqs[i].status {
-		case nodeStatusReady, nodeStatusNop:
-			go mkNode(g, prereqs[i], opts, required)
-			fallthrough
-		case nodeStatusStarted:
-			prereqs[i].listeners = append(prereqs[i].listeners, prereqstat)
-			pending++
-		}
-		prereqs[i].mutex.Unlock()
-	}
-
-	// wait until all the prereqs are built
-	status := nodeStatusDone
-	for pending > 0 {
-		s := <-prereqstat
-		pending--
-		if s == nodeStatusFailed {
-			status = nodeStatusFailed
-		}
-	}
-	return status
+// True if messages should be printed with fancy colors.
+// By default, if the output stream is not the terminal, colors are disabled.
+var color bool
+
+// Flags that only make sense for the top-level invocation, left out of
+// $MKFLAGS so that recursive invocations (cd dir && mk $MKFLAGS) use their
+// own directory and mkfile, leave the event stream and trace to the top-level
+// mk, don't each print a report, and build rather than ask, draw, check or
+// format.
+var toplevelFlags = map[string]bool{
+	"C": true, "f": true,
+	"events": true, "trace": true, "summary": true, "critical": true,
+	"I": true, "dot": true, "lint": true, "fmt": true,
 }
 
-// Build a target in the graph.
-//
-// This selects an appropriate rule (edge) and builds all prerequisites
-// concurrently.
-//
-// Args:
-//
-//	g: Graph in which the node lives.
-//	n: Node to (possibly) build.
-//	dryrun: Don't actually build anything, just pretend.
-//	required: Avoid building this node, unless its prereqs are out of date.
-func mkNode(g *graph, n *node, opts *buildOpts, required bool) {
-	// try to claim on this node
-	n.mutex.Lock()
-	if n.status != nodeStatusReady && n.status != nodeStatusNop {
-		n.mutex.Unlock()
-		return
-	} else {
-		n.status = nodeStatusStarted
-	}
-	n.mutex.Unlock()
-
-	// when finished, notify the listeners
-	finalstatus := nodeStatusDone
-	defer func() {
-		n.mutex.Lock()
-		n.status = finalstatus
-		for i := range n.listeners {
-			n.listeners[i] <- n.status
-		}
-		n.listeners = n.listeners[0:0]
-		n.mutex.Unlock()
-	}()
-
-	// there's no rules.
-	if len(n.prereqs) == 0 {
-		if !(n.r != nil && (n.r.attributes.virtual || n.r.attributes.forcedTimestamp)) && !n.exists {
-			wd, _ := os.Getwd()
-			mkError(fmt.Sprintf("don't know how to make %s in %s\n", n.name, wd))
-		}
-		finalstatus = nodeStatusNop
-		return
-	}
-
-	// There is exactly one rule among the edges (all edges share the same
-	// rule pointer, set by applyrules; newedge never creates edges with r==nil).
-	var prereqs []*node
-	var e *edge
-	for i := range n.prereqs {
-		if n.prereqs[i].r != nil {
-			e = n.prereqs[i]
+// Return the options given on the command line, one word each, for $MKFLAGS.
+func cmdlineFlags() []string {
+	flags := []string{}
+	flag.Visit(func(f *flag.Flag) {
+		if toplevelFlags[f.Name] {
+			return
 		}
-		if n.prereqs[i].v != nil {
-			prereqs = append(prereqs, n.prereqs[i].v)
-		}
-	}
-
-	prereqsRequired := required && (e.r.attributes.virtual || !n.exists || opts.forceIntermed)
-	if mkNodePrereqs(g, prereqs, opts, prereqsRequired) == nodeStatusFailed {
-		finalstatus = nodeStatusFailed
-	}
-
-	uptodate := true
-	if !e.r.attributes.virtual {
-		n.updateTimestamp(opts.rebuildall)
-		if !n.exists && required {
-			if opts.explain {
-				fmt.Fprintf(os.Stderr, "mk: %s does not exist\n", n.name)
-			}
-			uptodate = false
-		} else if len(e.r.command) > 0 && (n.exists || required) {
-			// P attribute: use custom program for staleness checking.
-			// Uses OS environment (not mk vars) because the program is an
-			// external tool (e.g. cmp -s), not a recipe.
-			for i := range prereqs {
-				args := append(append([]string{}, e.r.command[1:]...), n.name, prereqs[i].name)
-				_, ok := subprocess(e.r.command[0], args, os.Environ(), "", false)
-				if !ok {
-					if opts.explain {
-						fmt.Fprintf(os.Stderr, "mk: %s out of date via %s (P attribute)\n", n.name, prereqs[i].name)
-					}
-					uptodate = false
-					break
-				}
-			}
-		} else if n.exists || required {
-			for i := range prereqs {
-				if n.t.Before(prereqs[i].t) {
-					if opts.explain {
-						fmt.Fprintf(os.Stderr, "mk: %s older than %s\n", n.name, prereqs[i].name)
-					}
-					uptodate = false
-				} else if prereqs[i].status == nodeStatusDone {
-					if opts.explain {
-						fmt.Fprintf(os.Stderr, "mk: %s stale because %s was rebuilt\n", n.name, prereqs[i].name)
-					}
-					uptodate = false
-				}
-			}
-		}
-	} else {
-		if opts.explain && n.name != "" { // skip the root dummy node
-			fmt.Fprintf(os.Stderr, "mk: %s is virtual\n", n.name)
-		}
-		uptodate = false
-	}
-
-	_, isrebuildtarget := opts.rebuildTargets[n.name]
-	if isrebuildtarget || opts.rebuildall {
-		if opts.explain && uptodate {
-			fmt.Fprintf(os.Stderr, "mk: %s forced by -a/-w flag\n", n.name)
-		}
-		uptodate = false
-	}
-
-	// make another pass on the prereqs, since we know we need them now
-	if !uptodate {
-		if mkNodePrereqs(g, prereqs, opts, true) == nodeStatusFailed {
-			finalstatus = nodeStatusFailed
-		}
-	}
-
-	// Without -k, stop building when any recipe has failed.
-	if !opts.keepgoing && opts.failed.Load() {
-		finalstatus = nodeStatusFailed
-	}
-
-	// execute the recipe, unless the prereqs failed
-	if !uptodate && finalstatus != nodeStatusFailed && len(e.r.recipe) > 0 {
-		if opts.touchmode && !e.r.attributes.virtual {
-			// Touch mode: update the target's timestamp without running the recipe.
-			now := time.Now()
-			if !n.exists {
-				f, err := os.Create(n.name)
-				if err == nil {
-					f.Close()
-				}
-			} else {
-				os.Chtimes(n.name, now, now)
-			}
-			n.updateTimestamp(opts.rebuildall)
-		} else if !opts.touchmode {
-			var nproc int
-			if e.r.attributes.exclusive {
-				sched.reserveExclusive()
-				nproc = 0
-			} else {
-				nproc = sched.reserve()
-			}
-
-			if !dorecipe(n, e, opts, nproc) {
-				finalstatus = nodeStatusFailed
-				opts.failed.Store(true)
-				// D attribute: delete the target file when the recipe fails.
-				if e.r.attributes.delFailed {
-					os.Remove(n.name)
-				}
-			}
-			// U attribute: force timestamp so dependents see the target as updated
-			// even if the recipe didn't modify the file.
-			if finalstatus != nodeStatusFailed && e.r.attributes.update {
-				n.t = time.Now()
-			} else {
-				n.updateTimestamp(opts.rebuildall)
-			}
-
-			if e.r.attributes.exclusive {
-				sched.finishExclusive()
-			} else {
-				sched.finish()
-			}
-		}
-	} else if finalstatus != nodeStatusFailed {
-		if opts.explain && uptodate && !e.r.attributes.virtual {
-			fmt.Fprintf(os.Stderr, "mk: %s is up to date\n", n.name)
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() && f.Value.String() == "true" {
+			flags = append(flags, "-"+f.Name)
+		} else {
+			flags = append(flags, "-"+f.Name+"="+f.Value.String())
 		}
-		finalstatus = nodeStatusNop
-	}
+	})
+	return flags
 }
 
-func mkError(msg string) {
-	mkPrintError(msg)
+// Print an error, or each of a joined list of them, and exit.
+func mkError(err error) {
+	mkPrintError(err)
 	os.Exit(1)
 }
 
-func mkPrintError(msg string) {
-	if color {
-		os.Stderr.WriteString(ansiTermRed)
+func mkPrintError(err error) {
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
 	}
-	fmt.Fprintf(os.Stderr, "error: %s\n", msg)
-	if color {
-		os.Stderr.WriteString(ansiTermDefault)
+	for _, err := range errs {
+		if color {
+			os.Stderr.WriteString(ansiTermRed)
+		}
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		if color {
+			os.Stderr.WriteString(ansiTermDefault)
+		}
 	}
 }
 
-func mkPrintRecipe(target string, recipe string, quiet bool) {
-	mkMsgMutex.Lock()
-	if !color {
-		fmt.Printf("%s: ", target)
-	} else {
-		fmt.Printf("%s%s%s → %s",
-			ansiTermBlue+ansiTermBright+ansiTermUnderline, target,
-			ansiTermDefault, ansiTermBlue)
-	}
-	if quiet {
-		if !color {
-			fmt.Println("...")
-		} else {
-			fmt.Println("…")
-		}
-	} else {
-		printIndented(os.Stdout, recipe, len(target)+3)
-		if len(recipe) == 0 {
-			os.Stdout.WriteString("\n")
+// Open an event stream. The destination is a file name, or fd:N for a file
+// descriptor inherited from the parent process.
+func openEventLog(dest string) (io.WriteCloser, error) {
+	if fd, ok := strings.CutPrefix(dest, "fd:"); ok {
+		n, err := strconv.Atoi(fd)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid file descriptor %q", fd)
 		}
+		return os.NewFile(uintptr(n), dest), nil
 	}
-	if color {
-		os.Stdout.WriteString(ansiTermDefault)
-	}
-	mkMsgMutex.Unlock()
+	return os.Create(dest)
 }
 
 func main() {
 	var directory string
 	var mkfilepath string
 	var interactive bool
+	var summary, critical bool
+	var eventsDest, traceDest string
 	var shallowrebuild bool
-	var quiet bool
 	var dotOutput bool
-	var opts buildOpts
+	var format, lint bool
+	var noDatabase bool
+	var shell string
+	var keepShellArgs bool
+	var opts mk.Options
 
 	flag.StringVar(&directory, "C", "", "directory to change in to")
 	flag.StringVar(&mkfilepath, "f", "mkfile", "use the given file as mkfile")
-	flag.BoolVar(&opts.dryrun, "n", false, "print commands without actually executing")
-	flag.BoolVar(&opts.touchmode, "t", false, "touch targets instead of executing recipes")
+	flag.BoolVar(&opts.DryRun, "n", false, "print commands without actually executing")
+	flag.BoolVar(&opts.Touch, "t", false, "touch targets instead of executing recipes")
 	flag.BoolVar(&shallowrebuild, "r", false, "force building of just targets")
-	flag.BoolVar(&opts.rebuildall, "a", false, "force building of all dependencies")
-	flag.BoolVar(&opts.keepgoing, "k", false, "continue building after errors")
-	flag.StringVar(&pretendModified, "w", "", "pretend `target` was recently modified")
-	flag.IntVar(&sched.allowed, "p", -1, "maximum number of jobs to execute in parallel")
-	flag.IntVar(&maxRuleCnt, "l", 1, "maximum number of times a specific rule can be applied (recursion)")
+	flag.BoolVar(&opts.RebuildAll, "a", false, "force building of all dependencies")
+	flag.BoolVar(&opts.KeepGoing, "k", false, "continue building after errors")
+	flag.BoolVar(&opts.FailFast, "failfast", false, "abort running recipes when one fails (unless -k)")
+	flag.DurationVar(&opts.Timeout, "timeout", 0, "kill recipes that run longer than `duration` (0 for no limit)")
+	flag.StringVar(&opts.PretendModified, "w", "", "pretend `target` was recently modified")
+	flag.IntVar(&opts.Jobs, "p", -1, "maximum number of jobs to execute in parallel")
+	flag.IntVar(&opts.MaxRuleCount, "l", 1, "maximum number of times a specific rule can be applied (recursion)")
 	flag.BoolVar(&interactive, "I", false, "prompt before executing rules")
-	flag.BoolVar(&opts.forceIntermed, "i", false, "force rebuild of missing intermediates")
-	flag.BoolVar(&opts.explain, "e", false, "explain why targets are out of date")
-	flag.BoolVar(&quiet, "q", false, "don't print recipes before executing them")
+	flag.BoolVar(&opts.ForceIntermediates, "i", false, "force rebuild of missing intermediates")
+	flag.BoolVar(&opts.Explain, "e", false, "explain why targets are out of date")
+	flag.BoolVar(&opts.Hash, "hash", false, "decide staleness by comparing content digests instead of timestamps")
+	flag.BoolVar(&noDatabase, "nodb", false, "don't keep the build database (.mkdb) in the mkfile's directory")
+	flag.BoolVar(&opts.Quiet, "q", false, "don't print recipes before executing them")
 	flag.BoolVar(&dotOutput, "dot", false, "print dependency graph in graphviz dot format and exit")
+	flag.BoolVar(&lint, "lint", false, "check the mkfile for likely mistakes and exit")
+	flag.BoolVar(&format, "fmt", false, "rewrite the mkfile, or the files named, in canonical style and exit (with -n, only check it is)")
 	flag.BoolVar(&color, "color", isatty.IsTerminal(os.Stdout.Fd()), "turn color on/off")
-	flag.StringVar(&defaultShell, "shell", "sh -e", "default shell to use if none are specified via $shell")
-	flag.BoolVar(&dontDropArgs, "F", false, "don't drop shell arguments when no further arguments are specified")
+	flag.StringVar(&shell, "shell", "sh -e", "default shell to use if none are specified via $shell")
+	flag.BoolVar(&keepShellArgs, "F", false, "don't drop shell arguments when no further arguments are specified")
+	flag.StringVar(&opts.Output, "output", "stream", "how recipe output is written: `mode` stream, buffered or oldest")
+	flag.StringVar(&eventsDest, "events", "", "write a JSON event stream of the build to `file` (or fd:N)")
+	flag.BoolVar(&summary, "summary", false, "print a summary of failed, skipped and slowest targets after the build")
+	flag.BoolVar(&critical, "critical", false, "print the critical path through the build and the least time it could take")
+	flag.StringVar(&traceDest, "trace", "", "write a timeline of recipes and waits to `file` in Chrome trace format")
 	// TODO(rjk): P9P mk command line compatability.
 	flag.Parse()
+	opts.Color = color
 
 	// Resolve parallelism: -p flag > $NPROC env > NumCPU
-	if sched.allowed < 0 {
+	if opts.Jobs < 0 {
 		if nproc := os.Getenv("NPROC"); nproc != "" {
 			if n, err := strconv.Atoi(nproc); err == nil && n > 0 {
-				sched.allowed = n
+				opts.Jobs = n
 			} else {
-				mkError(fmt.Sprintf("invalid $NPROC value: %q", nproc))
+				mkError(fmt.Errorf("invalid $NPROC value: %q", nproc))
 			}
 		} else {
-			sched.allowed = runtime.NumCPU()
+			opts.Jobs = runtime.NumCPU()
 		}
 	}
-	sched.cond = sync.NewCond(&sync.Mutex{})
+
+	// Stop the build on SIGINT or SIGTERM. A second signal kills the
+	// subprocesses without waiting out the grace period.
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	opts.Signals = sigs
 
 	if directory != "" {
 		err := os.Chdir(directory)
 		if err != nil {
-			mkError(fmt.Sprintf("changing directory to `%s' failed", directory))
+			mkError(fmt.Errorf("changing directory to `%s' failed", directory))
 		}
 	}
+	// Name the directory in messages, as in "don't know how to make x in dir".
+	opts.Dir, _ = os.Getwd()
 
-	mkfile, err := os.Open(mkfilepath)
-	if err != nil {
-		mkError("no mkfile found")
+	if eventsDest != "" {
+		w, err := openEventLog(eventsDest)
+		if err != nil {
+			mkError(fmt.Errorf("opening event stream: %s", err))
+		}
+		defer w.Close()
+		opts.Events = w
+	}
+	if traceDest != "" {
+		f, err := os.Create(traceDest)
+		if err != nil {
+			mkError(fmt.Errorf("opening trace: %s", err))
+		}
+		defer f.Close()
+		opts.Trace = f
 	}
-	input, _ := io.ReadAll(mkfile) // ReadAll on a regular file; error is not practically reachable.
-	mkfile.Close()
-
-	abspath, _ := filepath.Abs(mkfilepath)
 
 	env := make(map[string][]string)
 	for _, elem := range os.Environ() {
@@ -463,70 +189,95 @@ func main() {
 		env[vals[0]] = append(env[vals[0]], vals[1])
 	}
 
-	rs := parse(string(input), mkfilepath, abspath, env)
-	if quiet {
-		for i := range rs.rules {
-			rs.rules[i].attributes.quiet = true
+	popts := mk.ParseOptions{Env: env, Shell: shell, KeepShellArgs: keepShellArgs, Dir: opts.Dir}
+	if format {
+		paths := flag.Args()
+		if len(paths) == 0 {
+			paths = []string{mkfilepath}
 		}
+		if !formatFiles(paths, opts.DryRun) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	input, err := os.ReadFile(mkfilepath)
+	if err != nil {
+		mkError(errors.New("no mkfile found"))
 	}
+	abspath, _ := filepath.Abs(mkfilepath)
 
 	// Separate command-line variable overrides (VAR=value) from targets.
-	var targets []string
+	var overrides []string
 	for _, arg := range flag.Args() {
-		if i := strings.Index(arg, "="); i > 0 && isValidVarName(arg[:i]) {
-			rs.vars[arg[:i]] = expand(arg[i+1:], rs.vars, true)
+		if i := strings.Index(arg, "="); i > 0 && mk.IsVarName(arg[:i]) {
+			overrides = append(overrides, arg)
 		} else {
-			targets = append(targets, arg)
+			opts.Targets = append(opts.Targets, arg)
 		}
 	}
+	env["MKFLAGS"] = append(cmdlineFlags(), overrides...)
+	env["MKARGS"] = append([]string{}, opts.Targets...)
 
-	// build the first non-meta rule in the makefile, if none are given explicitly
-	if len(targets) == 0 {
-		for i := range rs.rules {
-			if !rs.rules[i].ismeta {
-				for j := range rs.rules[i].targets {
-					targets = append(targets, rs.rules[i].targets[j].spat)
-				}
-				break
-			}
+	rs, err := mk.Parse(string(input), mkfilepath, abspath, popts)
+	if err != nil {
+		mkError(err)
+	}
+	for _, arg := range overrides {
+		name, value, _ := strings.Cut(arg, "=")
+		if err := rs.SetVar(name, value); err != nil {
+			mkError(err)
 		}
 	}
 
-	if len(targets) == 0 {
-		fmt.Println("mk: nothing to mk")
+	if lint {
+		ds := mk.Lint(rs)
+		for _, d := range ds {
+			fmt.Fprintln(os.Stderr, d)
+		}
+		if len(ds) > 0 {
+			os.Exit(1)
+		}
 		return
 	}
+	for _, d := range rs.Warnings() {
+		fmt.Fprintln(os.Stderr, d)
+	}
 
-	opts.rebuildTargets = make(map[string]bool)
+	// build the first non-meta rule in the makefile, if none are given explicitly
+	if len(opts.Targets) == 0 {
+		opts.Targets = rs.DefaultTargets()
+	}
+	if len(opts.Targets) == 0 {
+		fmt.Println("mk: nothing to mk")
+		return
+	}
 	if shallowrebuild {
-		for i := range targets {
-			opts.rebuildTargets[targets[i]] = true
-		}
+		opts.Rebuild = opts.Targets
 	}
 
-	// Create a dummy virtual rule that depends on every target
-	root := rule{}
-	root.targets = []pattern{{false, "", nil}}
-	root.attributes = attribSet{virtual: true}
-	root.prereqs = targets
-	rs.add(root)
-
 	if dotOutput {
-		g := buildgraph(rs, "", opts.rebuildall)
-		g.visualize(os.Stdout)
+		g, err := mk.BuildGraph(rs, opts)
+		if err != nil {
+			mkError(err)
+		}
+		g.WriteDot(os.Stdout)
 		return
 	}
 
-	opts.vars = rs.vars
-	opts.unexportedVars = rs.unexportedVars
+	// Recipes and digests are remembered between runs in the mkfile's directory.
+	if !noDatabase {
+		opts.Database = filepath.Join(filepath.Dir(abspath), mk.DatabaseName)
+	}
 
+	ctx := context.Background()
 	if interactive {
-		g := buildgraph(rs, "", opts.rebuildall)
 		// Preview: dry-run to show what would be built.
-		savedDryrun := opts.dryrun
-		opts.dryrun = true
-		mkNode(g, g.root, &opts, true)
-		opts.dryrun = savedDryrun
+		preview := opts
+		preview.DryRun, preview.Events, preview.Trace = true, nil, nil
+		if _, err := mk.Build(ctx, rs, preview); err != nil {
+			exit(err)
+		}
 		fmt.Print("Proceed? ")
 		in := bufio.NewReader(os.Stdin)
 		for {
@@ -543,19 +294,61 @@ func main() {
 		}
 	}
 
-	g := buildgraph(rs, "", opts.rebuildall)
+	res, err := mk.Build(ctx, rs, opts)
+	if err != nil {
+		exit(err)
+	}
+	if summary {
+		res.WriteSummary(os.Stderr)
+	}
+	if critical {
+		res.WriteCriticalPath(os.Stderr)
+	}
+	if res.Failed {
+		os.Exit(1)
+	}
+}
 
-	// -w flag: pretend a target was recently modified.
-	if pretendModified != "" {
-		if n, ok := g.nodes[pretendModified]; ok {
-			n.t = time.Now()
-			n.flags |= nodeFlagProbable | nodeFlagForcedTime
+// Rewrite mkfiles in canonical style, or with check set, report those that
+// aren't. Return whether all were, or now are.
+func formatFiles(paths []string, check bool) bool {
+	ok := true
+	for _, path := range paths {
+		input, err := os.ReadFile(path)
+		if err != nil {
+			mkPrintError(err)
+			ok = false
+			continue
+		}
+		out, err := mk.Format(string(input), path)
+		switch {
+		case err != nil:
+			mkPrintError(err)
+			ok = false
+		case out == string(input):
+		case check:
+			fmt.Fprintf(os.Stderr, "mk: %s is not formatted\n", path)
+			ok = false
+		default:
+			if err := os.WriteFile(path, []byte(out), 0o666); err != nil {
+				mkPrintError(err)
+				ok = false
+			}
 		}
 	}
+	return ok
+}
 
-	mkNode(g, g.root, &opts, true)
-	if g.root.status == nodeStatusFailed {
-		os.Exit(1)
+// Exit after a build stopped by err. An interrupted mk exits with status 128
+// plus the signal number, as a shell reports a command killed by a signal.
+func exit(err error) {
+	var interrupted *mk.Interrupted
+	if !errors.As(err, &interrupted) {
+		mkError(err)
 	}
+	status := 1
+	if s, ok := interrupted.Signal.(syscall.Signal); ok {
+		status = 128 + int(s)
+	}
+	os.Exit(status)
 }
-
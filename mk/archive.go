@@ -0,0 +1,217 @@
+// Archive members. A name of the form lib(member) refers to a member of the
+// ar(1) archive lib; its timestamp is the one recorded in the archive.
+
+package mk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	arMagic      = "!<arch>\n"
+	arThinMagic  = "!<thin>\n"
+	arHeaderSize = 60
+)
+
+// A member of an archive.
+type arMember struct {
+	name   string
+	mtime  time.Time
+	offset int64 // offset of the member's header in the archive
+}
+
+// Parsed archives, keyed by name, reused while the archive is unchanged.
+type arCache struct {
+	sync.Mutex
+	archives map[string]*arCacheEntry
+}
+
+type arCacheEntry struct {
+	size    int64
+	mtime   time.Time
+	members map[string]arMember
+}
+
+// Split an archive member reference lib(member) into its parts.
+func splitMember(name string) (archive, member string, ok bool) {
+	i := strings.IndexByte(name, '(')
+	if i <= 0 || !strings.HasSuffix(name, ")") || i+2 >= len(name) {
+		return "", "", false
+	}
+	return name[:i], name[i+1 : len(name)-1], true
+}
+
+// Return the modification time recorded for an archive member, or false if
+// the archive or the member doesn't exist.
+func (w *workDir) memberTime(archive, member string) (time.Time, bool) {
+	members, err := w.archiveMembers(archive)
+	if err != nil {
+		return time.Time{}, false
+	}
+	m, ok := members[member]
+	return m.mtime, ok
+}
+
+// Return the members of an archive, by name.
+func (w *workDir) archiveMembers(archive string) (map[string]arMember, error) {
+	info, err := os.Stat(w.path(archive))
+	if err != nil {
+		return nil, err
+	}
+
+	w.archives.Lock()
+	defer w.archives.Unlock()
+	if ce, ok := w.archives.archives[archive]; ok && ce.size == info.Size() && ce.mtime.Equal(info.ModTime()) {
+		return ce.members, nil
+	}
+
+	f, err := os.Open(w.path(archive))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	list, err := readArchive(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", archive, err)
+	}
+	members := make(map[string]arMember, len(list))
+	for _, m := range list {
+		// With duplicate names, ar operates on the first.
+		if _, ok := members[m.name]; !ok {
+			members[m.name] = m
+		}
+	}
+
+	if w.archives.archives == nil {
+		w.archives.archives = make(map[string]*arCacheEntry)
+	}
+	w.archives.archives[archive] = &arCacheEntry{size: info.Size(), mtime: info.ModTime(), members: members}
+	return members, nil
+}
+
+// Read the member headers of an archive in the common (System V/GNU and BSD)
+// formats.
+func readArchive(r io.ReadSeeker) ([]arMember, error) {
+	magic := make([]byte, len(arMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, errors.New("not an archive")
+	}
+	thin := string(magic) == arThinMagic
+	if !thin && string(magic) != arMagic {
+		return nil, errors.New("not an archive")
+	}
+
+	var members []arMember
+	var longNames []byte // GNU extended name table ("//" member)
+	offset := int64(len(arMagic))
+	hdr := make([]byte, arHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, hdr); err == io.EOF {
+			return members, nil
+		} else if err != nil {
+			return nil, errors.New("truncated archive header")
+		}
+		if string(hdr[58:60]) != "`\n" {
+			return nil, errors.New("malformed archive header")
+		}
+		name := strings.TrimRight(string(hdr[0:16]), " ")
+		date, _ := strconv.ParseInt(strings.TrimSpace(string(hdr[16:28])), 10, 64)
+		size, err := strconv.ParseInt(strings.TrimSpace(string(hdr[48:58])), 10, 64)
+		if err != nil || size < 0 {
+			return nil, errors.New("malformed archive member size")
+		}
+
+		special := false
+		skip := size
+		switch {
+		case name == "/" || name == "/SYM64/" || strings.HasPrefix(name, "__.SYMDEF"):
+			// symbol table
+			special = true
+		case name == "//":
+			special = true
+			longNames = make([]byte, size)
+			if _, err := io.ReadFull(r, longNames); err != nil {
+				return nil, errors.New("truncated archive name table")
+			}
+			skip = 0
+		case strings.HasPrefix(name, "#1/"):
+			// BSD: the name precedes the member's data.
+			n, err := strconv.Atoi(name[3:])
+			if err != nil || int64(n) > size {
+				return nil, errors.New("malformed archive member name")
+			}
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, errors.New("truncated archive member name")
+			}
+			name = string(bytes.TrimRight(buf, "\x00"))
+			skip = size - int64(n)
+		case len(name) > 1 && name[0] == '/':
+			// GNU: an offset into the extended name table.
+			n, err := strconv.Atoi(name[1:])
+			if err != nil || n >= len(longNames) {
+				return nil, errors.New("malformed archive member name")
+			}
+			name = string(longNames[n:])
+			if i := strings.Index(name, "/\n"); i >= 0 {
+				name = name[:i]
+			}
+		default:
+			name = strings.TrimSuffix(name, "/")
+		}
+
+		if !special {
+			members = append(members, arMember{name: name, mtime: time.Unix(date, 0), offset: offset})
+			if thin {
+				// Thin archives don't hold the members' data.
+				skip = 0
+				size = 0
+			}
+		}
+
+		// Data is padded to an even offset.
+		if size%2 == 1 {
+			size++
+			skip++
+		}
+		if _, err := r.Seek(skip, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		offset += arHeaderSize + size
+	}
+}
+
+// Set the modification time recorded for an archive member.
+func (w *workDir) touchMember(archive, member string, t time.Time) error {
+	members, err := w.archiveMembers(archive)
+	if err != nil {
+		return err
+	}
+	m, ok := members[member]
+	if !ok {
+		return fmt.Errorf("%s is not a member of %s", member, archive)
+	}
+
+	f, err := os.OpenFile(w.path(archive), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	date := fmt.Sprintf("%-12d", t.Unix())
+	_, err = f.WriteAt([]byte(date), m.offset+16)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	w.archives.Lock()
+	delete(w.archives.archives, archive)
+	w.archives.Unlock()
+	return err
+}
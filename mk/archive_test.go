@@ -0,0 +1,131 @@
+package mk
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Format an archive member header.
+func arHeader(name string, date int64, size int) string {
+	return fmt.Sprintf("%-16s%-12d%-6d%-6d%-8s%-10d`\n", name, date, 0, 0, "644", size)
+}
+
+func TestSplitMember(t *testing.T) {
+	tests := []struct {
+		name            string
+		archive, member string
+		ok              bool
+	}{
+		{"lib.a(foo.o)", "lib.a", "foo.o", true},
+		{"dir/lib.a(foo.o)", "dir/lib.a", "foo.o", true},
+		{"lib.a", "", "", false},
+		{"lib.a()", "", "", false},
+		{"(foo.o)", "", "", false},
+		{"lib.a(foo.o", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive, member, ok := splitMember(tt.name)
+			if archive != tt.archive || member != tt.member || ok != tt.ok {
+				t.Errorf("splitMember(%q) = %q, %q, %v, want %q, %q, %v",
+					tt.name, archive, member, ok, tt.archive, tt.member, tt.ok)
+			}
+		})
+	}
+}
+
+func TestReadArchive(t *testing.T) {
+	longName := "a_rather_long_member_name.o"
+	tests := []struct {
+		name  string
+		input string
+		want  map[string]int64
+	}{
+		{
+			name:  "gnu",
+			input: arMagic + arHeader("/", 1, 4) + "syms" + arHeader("a.o/", 100, 3) + "abc\n" + arHeader("b.o/", 200, 2) + "de",
+			want:  map[string]int64{"a.o": 100, "b.o": 200},
+		},
+		{
+			name: "gnu_long_names",
+			input: arMagic + arHeader("//", 0, len(longName)+2) + longName + "/\n\n" +
+				arHeader("/0", 300, 1) + "x\n",
+			want: map[string]int64{longName: 300},
+		},
+		{
+			name:  "bsd",
+			input: arMagic + arHeader("__.SYMDEF", 1, 2) + "xx" + arHeader("#1/8", 400, 9) + "c.o\x00\x00\x00\x00\x00" + "z\n",
+			want:  map[string]int64{"c.o": 400},
+		},
+		{
+			name:  "thin",
+			input: arThinMagic + arHeader("d.o/", 500, 1000),
+			want:  map[string]int64{"d.o": 500},
+		},
+		{
+			name:  "empty",
+			input: arMagic,
+			want:  map[string]int64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			members, err := readArchive(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("readArchive: %v", err)
+			}
+			got := make(map[string]int64)
+			for _, m := range members {
+				got[m.name] = m.mtime.Unix()
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadArchiveErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"not_archive", "hello, world\n"},
+		{"truncated_header", arMagic + "a.o/"},
+		{"bad_fmag", arMagic + strings.Repeat(" ", arHeaderSize)},
+		{"bad_long_name", arMagic + arHeader("/5", 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readArchive(strings.NewReader(tt.input)); err == nil {
+				t.Errorf("readArchive(%q) succeeded, want error", tt.input)
+			}
+		})
+	}
+}
+
+func TestTouchMember(t *testing.T) {
+	wd := &workDir{dir: t.TempDir()}
+	archive := "lib.a"
+	input := arMagic + arHeader("a.o/", 100, 1) + "a\n" + arHeader("b.o/", 200, 1) + "b\n"
+	if err := os.WriteFile(wd.path(archive), []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	when := time.Unix(12345, 0)
+	if err := wd.touchMember(archive, "b.o", when); err != nil {
+		t.Fatalf("touchMember: %v", err)
+	}
+	if got, ok := wd.memberTime(archive, "b.o"); !ok || !got.Equal(when) {
+		t.Errorf("memberTime(b.o) = %v, %v, want %v", got, ok, when)
+	}
+	if got, _ := wd.memberTime(archive, "a.o"); got.Unix() != 100 {
+		t.Errorf("memberTime(a.o) = %v, want unchanged", got.Unix())
+	}
+	if err := wd.touchMember(archive, "c.o", when); err == nil {
+		t.Error("touchMember of a missing member succeeded")
+	}
+}
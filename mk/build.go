@@ -0,0 +1,648 @@
+package mk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scheduler controls parallel recipe execution, limiting the number of
+// concurrent subprocesses. Jobs that can't have what they ask for wait in
+// line, and are handed it as it is given back; no goroutine waits.
+type scheduler struct {
+	mutex   sync.Mutex
+	allowed int
+	running int
+	inuse   []bool        // slots held by running jobs, by number
+	queue   []*slotWaiter // jobs waiting for slots, most urgent first
+
+	// Named pools, declared by $MKPOOLS, each limiting the recipes assigned
+	// to it by the L attribute.
+	pools map[string]*pool
+}
+
+// A pool limiting how many recipes of some class run at once.
+type pool struct {
+	capacity int
+	running  int
+	waiting  []func() // jobs waiting for a place, in order of arrival
+}
+
+// The configuration and state of a build.
+type buildOpts struct {
+	Options
+	vars           map[string][]string
+	unexportedVars map[string]bool
+	shell          shellConfig
+	rebuildTargets map[string]bool
+	db             *buildDB   // what previous builds recorded
+	sched          *scheduler // controls parallel recipe execution
+	events         *eventLog  // where events are written, or nil
+	trace          *traceLog  // where the timeline is collected, or nil
+	outputs        *outputs   // the output of running recipes
+	procs          *procTable // the subprocesses being run
+	wd             *workDir   // where the targets' files are
+	msgMutex       sync.Mutex // keeps messages from being interleaved
+	failed         atomic.Bool
+}
+
+// A job waiting for slots.
+type slotWaiter struct {
+	slots    int
+	priority time.Duration
+	ready    func(slots []int) // called with the slots once they're given
+	granted  []int             // the slots it was given
+}
+
+// Reserve n subprocess slots, or all of them if n is larger. Returns their
+// 0-based numbers if they can be had at once; otherwise nil, and ready is
+// called with them when a finishing job gives them up.
+//
+// Waiting jobs get their slots in order of priority, and in order of arrival
+// among equals. A job waiting for several slots holds up those behind it, so
+// that a steady stream of small jobs can't starve it.
+func (s *scheduler) reserve(n int, priority time.Duration, ready func(slots []int)) []int {
+	s.mutex.Lock()
+	w := &slotWaiter{slots: max(1, min(n, s.allowed)), priority: priority, ready: ready}
+	i := slices.IndexFunc(s.queue, func(o *slotWaiter) bool { return o.priority < priority })
+	if i < 0 {
+		i = len(s.queue)
+	}
+	s.queue = slices.Insert(s.queue, i, w)
+	granted := s.grant()
+	s.mutex.Unlock()
+
+	var slots []int
+	for _, g := range granted {
+		if g == w {
+			slots = g.granted
+		} else {
+			g.ready(g.granted)
+		}
+	}
+	return slots
+}
+
+// Give slots to the jobs at the head of the queue, as many as fit, and
+// return them. Called with the scheduler locked.
+func (s *scheduler) grant() []*slotWaiter {
+	if len(s.inuse) < s.allowed {
+		s.inuse = make([]bool, s.allowed)
+	}
+	var granted []*slotWaiter
+	for len(s.queue) > 0 && s.running+s.queue[0].slots <= s.allowed {
+		w := s.queue[0]
+		s.queue = s.queue[1:]
+		for i := 0; len(w.granted) < w.slots; i++ {
+			if !s.inuse[i] {
+				s.inuse[i] = true
+				w.granted = append(w.granted, i)
+			}
+		}
+		s.running += w.slots
+		granted = append(granted, w)
+	}
+	return granted
+}
+
+// Free the slots of a finished subprocess, giving them to the jobs waiting
+// for them.
+func (s *scheduler) finish(slots []int) {
+	s.mutex.Lock()
+	for _, i := range slots {
+		s.inuse[i] = false
+	}
+	s.running -= len(slots)
+	granted := s.grant()
+	s.mutex.Unlock()
+	for _, w := range granted {
+		w.ready(w.granted)
+	}
+}
+
+// Take a place in the named pool. Returns true if there was room; otherwise
+// the wait function, if not nil, is called, and ready is called once a
+// finishing recipe hands its place over, in order of arrival.
+func (s *scheduler) reservePool(name string, wait func(running int), ready func()) bool {
+	p := s.pools[name]
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if p.running < p.capacity {
+		p.running++
+		return true
+	}
+	if wait != nil {
+		wait(p.running)
+	}
+	p.waiting = append(p.waiting, ready)
+	return false
+}
+
+// Return a recipe's place in the named pool, handing it to the first recipe
+// waiting for one.
+func (s *scheduler) finishPool(name string) {
+	p := s.pools[name]
+	s.mutex.Lock()
+	if len(p.waiting) == 0 {
+		p.running--
+		s.mutex.Unlock()
+		return
+	}
+	ready := p.waiting[0]
+	p.waiting = p.waiting[1:]
+	s.mutex.Unlock()
+	ready()
+}
+
+// Give up the job slots and pool place reserved for a node's recipe.
+func finishJob(e *edge, opts *buildOpts, slots []int) {
+	opts.sched.finish(slots)
+	if e.r.attributes.pool != "" {
+		opts.sched.finishPool(e.r.attributes.pool)
+	}
+}
+
+// Parse pool declarations of the form name:capacity, as given in $MKPOOLS.
+func parsePools(decls []string) (map[string]*pool, error) {
+	pools := make(map[string]*pool, len(decls))
+	for _, decl := range decls {
+		name, capacity, ok := strings.Cut(decl, ":")
+		n, err := strconv.Atoi(capacity)
+		if !ok || !isValidVarName(name) || err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid pool declaration %q in $MKPOOLS, expected name:capacity", decl)
+		}
+		pools[name] = &pool{capacity: n}
+	}
+	return pools, nil
+}
+
+// Ansi color codes.
+const (
+	ansiTermDefault = "\033[0m"
+	// ansiTermBlack   = "\033[30m"
+	ansiTermRed = "\033[31m"
+	// ansiTermGreen  = "\033[32m"
+	// ansiTermYellow = "\033[33m"
+	ansiTermBlue = "\033[34m"
+	// ansiTermMagenta = "\033[35m"
+	ansiTermBright    = "\033[1m"
+	ansiTermUnderline = "\033[4m"
+)
+
+// Begin making a node: pick its rule (edge) and make its prerequisites, if
+// it has any.
+func (x *executor) start(j *job) bool {
+	n, opts := j.n, x.opts
+	if n.name != "" {
+		opts.events.emit(event{Type: eventNodeStart, Target: n.name})
+	}
+
+	// there's no rules.
+	if len(n.prereqs) == 0 {
+		if !(n.r != nil && (n.r.attributes.virtual || n.r.attributes.forcedTimestamp)) && !n.exists {
+			if opts.Dir != "" {
+				x.stop(fmt.Errorf("don't know how to make %s in %s", n.name, opts.Dir))
+			} else {
+				x.stop(fmt.Errorf("don't know how to make %s", n.name))
+			}
+			j.status = nodeStatusFailed
+		} else {
+			j.status = nodeStatusNop
+		}
+		j.phase = phaseDone
+		return false
+	}
+
+	// There is exactly one rule among the edges (all edges share the same
+	// rule pointer, set by applyrules; newedge never creates edges with r==nil).
+	j.prereqs = make([]*node, 0, len(n.prereqs))
+	for i := range n.prereqs {
+		if n.prereqs[i].r != nil {
+			j.e = n.prereqs[i]
+		}
+		if n.prereqs[i].v != nil {
+			j.prereqs = append(j.prereqs, n.prereqs[i].v)
+		}
+	}
+
+	prereqsRequired := j.required && (j.e.r.attributes.virtual || !n.exists || opts.ForceIntermediates)
+	return x.await(j, prereqsRequired, phaseCheck)
+}
+
+// Decide whether a node is out of date, now that its prerequisites are made
+// as far as they need to be, and if so make sure all of them are.
+func (x *executor) check(j *job) bool {
+	n, e, prereqs, opts := j.n, j.e, j.prereqs, x.opts
+	if j.failed {
+		j.status = nodeStatusFailed
+	}
+
+	uptodate := true
+	if !e.r.attributes.virtual {
+		n.updateTimestamp(opts.wd, opts.RebuildAll)
+		if !n.exists && j.required {
+			opts.explainStale(n, "does not exist")
+			uptodate = false
+		} else if len(e.r.command) > 0 && (n.exists || j.required) {
+			// P attribute: use custom program for staleness checking.
+			// Uses OS environment (not mk vars) because the program is an
+			// external tool (e.g. cmp -s), not a recipe.
+			for i := range prereqs {
+				args := append(append([]string{}, e.r.command[1:]...), n.name, prereqs[i].name)
+				_, ok := subprocess(opts.procs, e.r.command[0], args, os.Environ(), opts.Dir, "", false, nil)
+				if !ok {
+					opts.explainStale(n, fmt.Sprintf("out of date via %s (P attribute)", prereqs[i].name))
+					uptodate = false
+					break
+				}
+			}
+		} else if (opts.Hash || e.r.attributes.hash) && (n.exists || j.required) {
+			// H attribute or -hash: compare content digests against those
+			// recorded when the target was last built, falling back to
+			// timestamps (and recording the digests) when there is no record.
+			var recorded bool
+			uptodate, recorded = checkDigests(n, prereqs, opts)
+			if !recorded {
+				uptodate = checkTimestamps(n, prereqs, opts)
+				if uptodate && n.exists && !opts.DryRun {
+					opts.db.recordDigests(opts.wd, n, prereqs)
+				}
+			}
+		} else if n.exists || j.required {
+			uptodate = checkTimestamps(n, prereqs, opts)
+		}
+	} else {
+		if n.name != "" { // skip the root dummy node
+			opts.explainStale(n, "is virtual")
+		}
+		uptodate = false
+	}
+
+	// Rebuild when the recipe, its shell, or the variables it refers to
+	// changed since the target was last built. Targets built before there was
+	// a record are assumed to be current.
+	if uptodate && !e.r.attributes.virtual && n.exists && len(e.r.recipe) > 0 {
+		sig := recipeSignature(n, e, opts)
+		if old := opts.db.recipe(n.name); old == nil {
+			if !opts.DryRun {
+				opts.db.recordRecipe(n.name, sig)
+			}
+		} else if !old.equal(sig) {
+			opts.explainStale(n, "stale because recipe changed")
+			uptodate = false
+		}
+	}
+
+	_, isrebuildtarget := opts.rebuildTargets[n.name]
+	if isrebuildtarget || opts.RebuildAll {
+		if uptodate {
+			opts.explainStale(n, "forced by -a/-w flag")
+		}
+		uptodate = false
+	}
+	j.uptodate = uptodate
+
+	// make another pass on the prereqs, since we know we need them now
+	if !uptodate {
+		return x.await(j, true, phaseMake)
+	}
+	j.phase = phaseMake
+	return false
+}
+
+// Finish making a node, running its recipe if it is out of date.
+func (x *executor) make(j *job) {
+	n, e, prereqs, opts, uptodate := j.n, j.e, j.prereqs, x.opts, j.uptodate
+	if j.failed {
+		j.status = nodeStatusFailed
+	}
+	skipReason := "a prerequisite failed"
+
+	// Without -k, stop building when any recipe has failed.
+	if !opts.KeepGoing && opts.failed.Load() && j.status != nodeStatusFailed {
+		j.status = nodeStatusFailed
+		skipReason = "another recipe failed"
+	}
+	if !uptodate && j.status == nodeStatusFailed && n.name != "" {
+		opts.events.emit(event{Type: eventSkipped, Target: n.name, Reason: skipReason})
+	}
+
+	// execute the recipe, unless the prereqs failed
+	if !uptodate && j.status != nodeStatusFailed && len(e.r.recipe) > 0 {
+		if opts.Touch && !e.r.attributes.virtual {
+			// Touch mode: update the target's timestamp without running the recipe.
+			now := time.Now()
+			if archive, member, ok := splitMember(n.name); ok && n.flags&nodeFlagMember != 0 {
+				opts.wd.touchMember(archive, member, now)
+			} else if !n.exists {
+				f, err := os.Create(opts.wd.path(n.name))
+				if err == nil {
+					f.Close()
+				}
+			} else {
+				os.Chtimes(opts.wd.path(n.name), now, now)
+			}
+			n.updateTimestamp(opts.wd, opts.RebuildAll)
+			opts.db.recordRecipe(n.name, recipeSignature(n, e, opts))
+			if opts.Hash || e.r.attributes.hash {
+				opts.db.recordDigests(opts.wd, n, prereqs)
+			}
+		} else if !opts.Touch {
+			// The recipe runs once it has its pool place and job slots.
+			j.waitStart = time.Now()
+			j.phase = phasePool
+			return
+		}
+	} else if !uptodate && j.status != nodeStatusFailed && len(e.r.recipe) == 0 &&
+		e.r.attributes.forcedTimestamp && len(prereqs) > 0 {
+		// N attribute: an out of date target without a recipe has its time
+		// updated, so its dependents are remade (e.g. an archive member
+		// whose object file changed).
+		n.t = time.Now()
+	} else if j.status != nodeStatusFailed {
+		if uptodate && !e.r.attributes.virtual {
+			if opts.Explain {
+				opts.printf("mk: %s is up to date\n", n.name)
+			}
+			opts.events.emit(event{Type: eventUpToDate, Target: n.name})
+		}
+		j.status = nodeStatusNop
+	}
+	j.phase = phaseDone
+}
+
+// Take a place in the pool the L attribute names, if any, before any job
+// slots, so that waiting for the pool doesn't hold them. Returns true if the
+// job must wait for one, in which case it is queued again holding it.
+func (x *executor) reservePool(j *job) bool {
+	n, name, opts := j.n, j.e.r.attributes.pool, x.opts
+	j.phase = phaseSlots
+	if name == "" {
+		return false
+	}
+	wait := func(running int) {
+		reason := fmt.Sprintf("waiting for pool %s (%d running)", name, running)
+		if opts.Explain {
+			opts.printf("mk: %s %s\n", n.name, reason)
+		}
+		opts.events.emit(event{Type: eventPoolWait, Target: n.name, Reason: reason})
+	}
+	return !opts.sched.reservePool(name, wait, func() { x.requeue(j) })
+}
+
+// Reserve the job slots for a node's recipe: as many as the J attribute asks
+// for, or all of them for X. Returns true if the job must wait for them, in
+// which case it is queued again holding them.
+func (x *executor) reserveSlots(j *job) bool {
+	attrs := j.e.r.attributes
+	weight := attrs.weight
+	if attrs.exclusive {
+		weight = x.opts.sched.allowed
+	}
+	j.phase = phaseRun
+	slots := x.opts.sched.reserve(weight, j.priority, func(slots []int) {
+		j.slots = slots
+		x.requeue(j)
+	})
+	if slots == nil {
+		return true
+	}
+	j.slots = slots
+	return false
+}
+
+// Run a node's recipe, holding its pool place and job slots, and record what
+// it made. A failed recipe that the A attribute lets run again gives them up
+// and waits the backoff, without a worker, before it is queued to reserve
+// them again; it returns true. If the build is aborted or interrupted while
+// it waits, it is queued holding none, and fails without running.
+func (x *executor) runRecipe(j *job) bool {
+	n, e, prereqs, opts := j.n, j.e, j.prereqs, x.opts
+	if j.slots != nil && !opts.DryRun {
+		opts.trace.wait(n.name, j.waitStart, time.Now(), map[string]any{
+			"pool":      e.r.attributes.pool,
+			"weight":    max(1, e.r.attributes.weight),
+			"exclusive": e.r.attributes.exclusive,
+		})
+	}
+
+	ok := false
+	switch {
+	case j.slots == nil:
+		// Stopped while waiting to retry.
+	case j.attempt == 0 && opts.FailFast && !opts.KeepGoing && opts.failed.Load():
+		// -failfast: don't start a recipe that waited for its slots while
+		// another failed.
+		j.status = nodeStatusFailed
+		opts.events.emit(event{Type: eventSkipped, Target: n.name, Reason: "another recipe failed"})
+	default:
+		j.attempt++
+		ok = dorecipe(n, e, opts, j.slots)
+		attempts := e.r.attributes.retries + 1
+		if !ok && j.attempt < attempts && !opts.procs.aborted() {
+			opts.printf("mk: %s failed, retrying (attempt %d of %d)\n", n.name, j.attempt+1, attempts)
+			finishJob(e, opts, j.slots)
+			j.slots = nil
+			go x.retry(j)
+			return true
+		}
+		if ok && j.attempt > 1 {
+			opts.printf("mk: %s succeeded after %d attempts\n", n.name, j.attempt)
+		}
+	}
+	if !ok && j.status != nodeStatusFailed {
+		if j.attempt > 1 && !opts.procs.isInterrupted() {
+			opts.printf("mk: %s failed after %d attempts\n", n.name, j.attempt)
+		}
+		j.status = nodeStatusFailed
+		opts.failed.Store(true)
+		if opts.FailFast && !opts.KeepGoing {
+			opts.procs.abort()
+		}
+		// D attribute: delete the target file when the recipe fails.
+		if e.r.attributes.delFailed {
+			os.Remove(opts.wd.path(n.name))
+		}
+	}
+	// U attribute: force timestamp so dependents see the target as updated
+	// even if the recipe didn't modify the file.
+	if j.status != nodeStatusFailed && e.r.attributes.update {
+		n.t = time.Now()
+	} else {
+		n.updateTimestamp(opts.wd, opts.RebuildAll)
+	}
+	if j.status != nodeStatusFailed && !opts.DryRun && n.run != nil {
+		opts.db.recordDuration(n.name, n.run.duration)
+	}
+	if j.status != nodeStatusFailed && !opts.DryRun && !e.r.attributes.virtual {
+		opts.db.recordRecipe(n.name, recipeSignature(n, e, opts))
+		if opts.Hash || e.r.attributes.hash {
+			opts.db.recordDigests(opts.wd, n, prereqs)
+		}
+	}
+
+	if j.slots != nil {
+		finishJob(e, opts, j.slots)
+		j.slots = nil
+	}
+	j.phase = phaseDone
+	return false
+}
+
+// Wait the backoff before a job's recipe is run again, and queue it to
+// reserve its pool place and slots, or, if the build is stopped first, to
+// fail.
+func (x *executor) retry(j *job) {
+	if j.backoff == 0 {
+		j.backoff = j.e.r.attributes.backoff
+	} else {
+		j.backoff *= 2
+	}
+	if x.opts.procs.sleep(j.backoff) {
+		j.waitStart = time.Now()
+		j.phase = phasePool
+	}
+	x.requeue(j)
+}
+
+// Report why a target is out of date: on standard error with -e, and in the
+// event log.
+func (opts *buildOpts) explainStale(n *node, reason string) {
+	if opts.Explain {
+		opts.printf("mk: %s %s\n", n.name, reason)
+	}
+	opts.events.emit(event{Type: eventStale, Target: n.name, Reason: reason})
+}
+
+// Compare a target's timestamp with those of its prerequisites, returning
+// true if the target is up to date.
+func checkTimestamps(n *node, prereqs []*node, opts *buildOpts) bool {
+	uptodate := true
+	for i := range prereqs {
+		t := prereqs[i].t
+		if n.flags&nodeFlagMember != 0 {
+			// Archives record times to the second.
+			t = t.Truncate(time.Second)
+		}
+		if n.t.Before(t) {
+			opts.explainStale(n, "older than "+prereqs[i].name)
+			uptodate = false
+		} else if prereqs[i].status == nodeStatusDone {
+			opts.explainStale(n, fmt.Sprintf("stale because %s was rebuilt", prereqs[i].name))
+			uptodate = false
+		}
+	}
+	return uptodate
+}
+
+// Compare the digests of a target's prerequisites with those recorded in the
+// build database, returning true if the target is up to date. The second
+// result is false if nothing was recorded for the target.
+//
+// Prerequisites that are not regular files (virtual targets, directories)
+// have no digest; as with timestamps, they make the target stale when they
+// were rebuilt.
+func checkDigests(n *node, prereqs []*node, opts *buildOpts) (bool, bool) {
+	tr := opts.db.target(n.name)
+	if tr == nil || !n.exists {
+		return false, false
+	}
+	uptodate := true
+	for i := range prereqs {
+		d, ok := opts.db.digest(opts.wd, prereqs[i].name)
+		if !ok {
+			if prereqs[i].status == nodeStatusDone {
+				opts.explainStale(n, fmt.Sprintf("stale because %s was rebuilt", prereqs[i].name))
+				uptodate = false
+			}
+			continue
+		}
+		if old, ok := tr.Prereqs[prereqs[i].name]; !ok || old != d {
+			opts.explainStale(n, fmt.Sprintf("stale because digest of %s changed", prereqs[i].name))
+			uptodate = false
+		}
+	}
+	return uptodate, true
+}
+
+// An error that stops mk. Raised deep in parsing or building the graph by
+// mkError, and recovered by the functions of the package's API.
+type fatalError struct {
+	err error
+}
+
+func mkError(msg string) {
+	panic(fatalError{errors.New(msg)})
+}
+
+// Recover from a fatalError, setting *err to its error.
+func recoverFatal(err *error) {
+	if r := recover(); r != nil {
+		fe, ok := r.(fatalError)
+		if !ok {
+			panic(r)
+		}
+		*err = fe.err
+	}
+}
+
+// Print an error message to the build's standard error.
+func (opts *buildOpts) printError(msg string) {
+	var buf bytes.Buffer
+	if opts.Color {
+		buf.WriteString(ansiTermRed)
+	}
+	fmt.Fprintf(&buf, "error: %s\n", msg)
+	if opts.Color {
+		buf.WriteString(ansiTermDefault)
+	}
+	opts.msgMutex.Lock()
+	opts.Stderr.Write(buf.Bytes())
+	opts.msgMutex.Unlock()
+}
+
+// Print a recipe to out. The recipe is written at once, so it isn't
+// interleaved with other output.
+func (opts *buildOpts) printRecipe(out io.Writer, target string, recipe string, quiet bool) {
+	var buf bytes.Buffer
+	if !opts.Color {
+		fmt.Fprintf(&buf, "%s: ", target)
+	} else {
+		fmt.Fprintf(&buf, "%s%s%s → %s",
+			ansiTermBlue+ansiTermBright+ansiTermUnderline, target,
+			ansiTermDefault, ansiTermBlue)
+	}
+	if quiet || opts.Quiet {
+		if !opts.Color {
+			fmt.Fprintln(&buf, "...")
+		} else {
+			fmt.Fprintln(&buf, "…")
+		}
+	} else {
+		printIndented(&buf, recipe, len(target)+3)
+		if len(recipe) == 0 {
+			buf.WriteString("\n")
+		}
+	}
+	if opts.Color {
+		buf.WriteString(ansiTermDefault)
+	}
+	opts.msgMutex.Lock()
+	out.Write(buf.Bytes())
+	opts.msgMutex.Unlock()
+}
+
+// Print a message, such as an explanation, to the build's standard error.
+func (opts *buildOpts) printf(format string, args ...any) {
+	opts.msgMutex.Lock()
+	fmt.Fprintf(opts.Stderr, format, args...)
+	opts.msgMutex.Unlock()
+}
@@ -0,0 +1,129 @@
+package mk
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPrintRecipeEmptyRecipe(t *testing.T) {
+	// Cover printRecipe with empty recipe and quiet=false.
+	// This path is effectively dead in normal execution (rules with empty recipes
+	// are filtered before reaching dorecipe), but exercise it for coverage.
+	var buf bytes.Buffer
+	(&buildOpts{}).printRecipe(&buf, "target", "", false)
+	if got, want := buf.String(), "target: \n"; got != want {
+		t.Errorf("printRecipe empty recipe: got %q, want %q", got, want)
+	}
+}
+
+func TestMkNodeAlreadyClaimed(t *testing.T) {
+	// Calling mkNode on a node that's already been claimed (status != Ready/Nop)
+	// should return immediately without doing any work.
+	n := &node{
+		name:   "already-started",
+		status: nodeStatusStarted,
+	}
+	g := &Graph{nodes: map[string]*node{n.name: n}}
+	mkNode(g, n, &buildOpts{Options: Options{DryRun: true}}, false)
+	if n.status != nodeStatusStarted {
+		t.Errorf("status changed to %v, expected it to remain nodeStatusStarted", n.status)
+	}
+}
+
+func TestSchedulerReserveWeighted(t *testing.T) {
+	s := &scheduler{allowed: 4}
+
+	a := s.reserve(1, 0, nil)
+	b := s.reserve(2, 0, nil)
+	if !slices.Equal(a, []int{0}) || !slices.Equal(b, []int{1, 2}) {
+		t.Fatalf("reserve gave %v and %v, want [0] and [1 2]", a, b)
+	}
+	s.finish(a)
+	if c := s.reserve(2, 0, nil); !slices.Equal(c, []int{0, 3}) {
+		t.Errorf("reserve(2) after freeing slot 0 = %v, want [0 3]", c)
+	}
+
+	// A weight larger than the limit waits for, and is given, every slot.
+	var got []int
+	if slots := s.reserve(10, 0, func(slots []int) { got = slots }); slots != nil {
+		t.Fatalf("reserve(10) with slots in use = %v, want to wait", slots)
+	}
+	s.finish([]int{1, 2})
+	if got != nil {
+		t.Fatalf("reserve(10) given %v with slots in use", got)
+	}
+	s.finish([]int{0, 3})
+	if !slices.Equal(got, []int{0, 1, 2, 3}) {
+		t.Errorf("reserve(10) given %v, want [0 1 2 3]", got)
+	}
+}
+
+func TestSchedulerReservePriority(t *testing.T) {
+	s := &scheduler{allowed: 1}
+	first := s.reserve(1, 0, nil)
+
+	// Jobs queued behind the running one run most urgent first, and in order
+	// of arrival among equals. A slot that has been handed on isn't free to a
+	// newcomer of lower priority.
+	var got []string
+	for _, w := range []struct {
+		name     string
+		priority time.Duration
+	}{{"a", 1}, {"b", 3}, {"c", 2}, {"d", 3}} {
+		slots := s.reserve(1, w.priority, func(slots []int) {
+			got = append(got, w.name)
+			s.finish(slots)
+		})
+		if slots != nil {
+			t.Fatalf("job %s given %v while the slot is held", w.name, slots)
+		}
+	}
+	s.finish(first)
+	if want := []string{"b", "d", "c", "a"}; !slices.Equal(got, want) {
+		t.Errorf("jobs ran in order %q, want %q", got, want)
+	}
+}
+
+func TestSchedulerReservePool(t *testing.T) {
+	s := &scheduler{allowed: 4, pools: map[string]*pool{"link": {capacity: 1}}}
+	if !s.reservePool("link", nil, nil) {
+		t.Fatal("reservePool of an empty pool waited")
+	}
+
+	// Those waiting for a place are given it in order of arrival.
+	var got []int
+	for i := range 3 {
+		waited := false
+		ok := s.reservePool("link", func(running int) { waited = running == 1 }, func() { got = append(got, i) })
+		if ok || !waited {
+			t.Fatalf("reservePool of a full pool = %v, called wait: %v", ok, waited)
+		}
+	}
+	for range 3 {
+		s.finishPool("link")
+	}
+	if want := []int{0, 1, 2}; !slices.Equal(got, want) {
+		t.Errorf("waiters given places in order %v, want %v", got, want)
+	}
+	s.finishPool("link")
+	if p := s.pools["link"]; p.running != 0 || len(p.waiting) != 0 {
+		t.Errorf("pool after every place was returned: %+v", p)
+	}
+}
+
+func TestParsePools(t *testing.T) {
+	pools, err := parsePools([]string{"link:2", "db:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 2 || pools["link"].capacity != 2 || pools["db"].capacity != 1 {
+		t.Errorf("parsePools = %v", pools)
+	}
+	for _, decl := range []string{"link", "link:", "link:0", "link:-1", "link:x", ":2", "a b:2"} {
+		if _, err := parsePools([]string{decl}); err == nil {
+			t.Errorf("parsePools(%q) succeeded, want error", decl)
+		}
+	}
+}
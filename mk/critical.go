@@ -0,0 +1,127 @@
+// The critical path of a build: the chain of recipes, each waiting on the
+// last, that took longest. However many jobs run in parallel, the build can't
+// take less time than this chain, nor less than the total time spent in
+// recipes divided among the job slots.
+
+package mk
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// The critical path through a built graph.
+type criticalPath struct {
+	nodes   []*node       // in the order their recipes ran
+	length  time.Duration // sum of the nodes' recipe durations
+	work    time.Duration // recipe durations times the slots they held
+	recipes int           // number of recipes run
+}
+
+// Find the critical path through g, from the durations of the recipes run.
+func findCriticalPath(g *Graph) criticalPath {
+	var cp criticalPath
+	length := make(map[*node]time.Duration) // longest chain ending with the node
+	prev := make(map[*node]*node)           // the node before it on that chain
+	var visit func(n *node) time.Duration
+	visit = func(n *node) time.Duration {
+		if l, ok := length[n]; ok {
+			return l
+		}
+		length[n] = 0 // for safety on cycles, which buildgraph rejects
+		var longest time.Duration
+		for _, e := range n.prereqs {
+			if e.v == nil {
+				continue
+			}
+			if l := visit(e.v); l > longest {
+				longest, prev[n] = l, e.v
+			}
+		}
+		if n.run != nil {
+			longest += n.run.duration
+			cp.work += n.run.duration * time.Duration(n.run.slots)
+			cp.recipes++
+		}
+		length[n] = longest
+		return longest
+	}
+	cp.length = visit(g.root)
+	for n := prev[g.root]; n != nil; n = prev[n] {
+		if n.run != nil {
+			cp.nodes = append([]*node{n}, cp.nodes...)
+		}
+	}
+	return cp
+}
+
+// Set each node's priority to an estimate of how long the build takes from the
+// start of its recipe: the duration of its recipe, as the last successful run
+// took, plus those of the longest chain of recipes waiting on it. Running the
+// nodes with the highest priorities first keeps the critical path moving.
+func (g *Graph) prioritize(estimate func(name string) time.Duration) {
+	// List the nodes so that each comes after every node that depends on it.
+	var order []*node
+	seen := make(map[*node]bool)
+	var visit func(n *node)
+	visit = func(n *node) {
+		if seen[n] {
+			return
+		}
+		seen[n] = true
+		for _, e := range n.prereqs {
+			if e.v != nil {
+				visit(e.v)
+			}
+		}
+		order = append(order, n)
+	}
+	visit(g.root)
+	slices.Reverse(order)
+
+	for _, n := range order {
+		n.priority = 0
+	}
+	for _, n := range order {
+		if n != g.root {
+			n.priority += estimate(n.name)
+		}
+		for _, e := range n.prereqs {
+			if e.v != nil {
+				e.v.priority = max(e.v.priority, n.priority)
+			}
+		}
+	}
+}
+
+// The least time a build could take with p jobs in parallel.
+func (cp *criticalPath) minimum(p int) time.Duration {
+	return max(cp.length, cp.work/time.Duration(max(p, 1)))
+}
+
+// Print the critical path, and what it means for a build with p jobs.
+func (cp *criticalPath) print(w io.Writer, p int) {
+	fmt.Fprintf(w, "mk: critical path %s, through %d of %d recipes:\n",
+		cp.length.Round(time.Millisecond), len(cp.nodes), cp.recipes)
+	for _, n := range cp.nodes {
+		fmt.Fprintf(w, "\t%s\t%s\n", n.run.duration.Round(time.Millisecond), n.name)
+	}
+	fmt.Fprintf(w, "mk: %s of work; with -p %d, the build takes at least %s\n",
+		cp.work.Round(time.Millisecond), p, cp.minimum(p).Round(time.Millisecond))
+}
+
+// Describe the critical path as an event.
+func (cp *criticalPath) event(p int) event {
+	ev := event{
+		Type:     eventCriticalPath,
+		Duration: cp.length.Seconds(),
+		Work:     cp.work.Seconds(),
+		Minimum:  cp.minimum(p).Seconds(),
+	}
+	for _, n := range cp.nodes {
+		ev.Path = append(ev.Path, pathStep{n.name, n.run.duration.Seconds()})
+	}
+	return ev
+}
@@ -0,0 +1,73 @@
+package mk
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFindCriticalPath(t *testing.T) {
+	// all -> prog -> a.o, b.o; all -> doc. prog waits on the slower b.o.
+	g := &Graph{nodes: make(map[string]*node)}
+	src := newTestNode(g, "a.c", nil)
+	a := newTestNode(g, "a.o", &recipeRun{duration: 1 * time.Second, slots: 1}, src)
+	b := newTestNode(g, "b.o", &recipeRun{duration: 3 * time.Second, slots: 2})
+	prog := newTestNode(g, "prog", &recipeRun{duration: 2 * time.Second, slots: 1}, a, b)
+	doc := newTestNode(g, "doc", &recipeRun{duration: 4 * time.Second, slots: 1})
+	g.root = newTestNode(g, "", nil, prog, doc)
+
+	cp := findCriticalPath(g)
+	var names []string
+	for _, n := range cp.nodes {
+		names = append(names, n.name)
+	}
+	if want := []string{"b.o", "prog"}; !slices.Equal(names, want) {
+		t.Errorf("critical path = %q, want %q", names, want)
+	}
+	if cp.length != 5*time.Second {
+		t.Errorf("length = %s, want 5s", cp.length)
+	}
+	if cp.work != 13*time.Second {
+		t.Errorf("work = %s, want 13s", cp.work)
+	}
+	if cp.recipes != 4 {
+		t.Errorf("recipes = %d, want 4", cp.recipes)
+	}
+	if got := cp.minimum(1); got != 13*time.Second {
+		t.Errorf("minimum(1) = %s, want 13s", got)
+	}
+	if got := cp.minimum(8); got != 5*time.Second {
+		t.Errorf("minimum(8) = %s, want 5s", got)
+	}
+}
+
+func TestGraphPrioritize(t *testing.T) {
+	// all -> prog -> a.o -> a.c; all -> doc; test -> prog.
+	g := &Graph{nodes: make(map[string]*node)}
+	src := newTestNode(g, "a.c", nil)
+	a := newTestNode(g, "a.o", nil, src)
+	prog := newTestNode(g, "prog", nil, a)
+	test := newTestNode(g, "test", nil, prog)
+	doc := newTestNode(g, "doc", nil)
+	g.root = newTestNode(g, "", nil, prog, doc, test)
+
+	durations := map[string]time.Duration{"a.o": 1, "prog": 2, "test": 4, "doc": 5}
+	g.prioritize(func(name string) time.Duration { return durations[name] })
+	want := map[*node]time.Duration{src: 7, a: 7, prog: 6, test: 4, doc: 5}
+	for n, p := range want {
+		if n.priority != p {
+			t.Errorf("%s has priority %d, want %d", n.name, n.priority, p)
+		}
+	}
+}
+
+// Add a node to g with the given recipe run, nil if it ran none, and
+// prerequisites.
+func newTestNode(g *Graph, name string, run *recipeRun, prereqs ...*node) *node {
+	n := &node{name: name, run: run}
+	for _, v := range prereqs {
+		n.prereqs = append(n.prereqs, &edge{v: v})
+	}
+	g.nodes[name] = n
+	return n
+}
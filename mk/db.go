@@ -0,0 +1,225 @@
+// A small on-disk database remembering facts about previous builds, so that
+// staleness can be decided by more than modification times.
+
+package mk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Name of the build database, kept in the mkfile's directory.
+const buildDBName = ".mkdb"
+
+// Format version of the build database; databases with another version are
+// discarded.
+const buildDBVersion = 1
+
+// A cached digest of a file's contents, valid while the size and modification
+// time are unchanged.
+type fileRecord struct {
+	Size   int64     `json:"size"`
+	Mtime  time.Time `json:"mtime"`
+	Digest string    `json:"digest"`
+}
+
+// How a target's recipe was run.
+type recipeRecord struct {
+	Recipe string            `json:"recipe"`         // recipe text, with variables expanded
+	Shell  []string          `json:"shell"`          // shell and its arguments
+	Vars   map[string]string `json:"vars,omitempty"` // exported variables the recipe refers to
+}
+
+// Report whether two recipe records describe the same invocation.
+func (rr *recipeRecord) equal(rr2 *recipeRecord) bool {
+	return rr.Recipe == rr2.Recipe && slices.Equal(rr.Shell, rr2.Shell) && maps.Equal(rr.Vars, rr2.Vars)
+}
+
+// What was recorded about a target when its recipe last succeeded.
+type targetRecord struct {
+	Prereqs  map[string]string `json:"prereqs,omitempty"` // prereq name to digest
+	Recipe   *recipeRecord     `json:"recipe,omitempty"`
+	Duration time.Duration     `json:"duration,omitempty"` // how long the recipe took
+}
+
+// The build database.
+type buildDB struct {
+	path    string
+	mutex   sync.Mutex
+	dirty   bool
+	Version int                      `json:"version"`
+	Files   map[string]*fileRecord   `json:"files"`
+	Targets map[string]*targetRecord `json:"targets"`
+}
+
+// Load the build database at path. A missing or unreadable database, or an
+// empty path, yields an empty one.
+func loadBuildDB(path string) *buildDB {
+	db := &buildDB{path: path}
+	if data, err := os.ReadFile(path); err == nil {
+		if json.Unmarshal(data, db) != nil || db.Version != buildDBVersion {
+			db.Files = nil
+			db.Targets = nil
+		}
+	}
+	db.Version = buildDBVersion
+	if db.Files == nil {
+		db.Files = make(map[string]*fileRecord)
+	}
+	if db.Targets == nil {
+		db.Targets = make(map[string]*targetRecord)
+	}
+	return db
+}
+
+// Write the database back to disk if anything changed. A database without a
+// path is kept only for the build.
+func (db *buildDB) save() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if !db.dirty || db.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(db)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(db.path), buildDBName+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), db.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	db.dirty = false
+	return nil
+}
+
+// Return the digest of the contents of a file named relative to wd, or false
+// if the file cannot be read (it does not exist, or is a directory). Digests
+// are cached by size and modification time so unchanged files are read only
+// once.
+func (db *buildDB) digest(wd *workDir, name string) (string, bool) {
+	info, err := os.Stat(wd.path(name))
+	if err != nil || !info.Mode().IsRegular() {
+		return "", false
+	}
+
+	db.mutex.Lock()
+	fr, ok := db.Files[name]
+	db.mutex.Unlock()
+	if ok && fr.Size == info.Size() && fr.Mtime.Equal(info.ModTime()) {
+		return fr.Digest, true
+	}
+
+	f, err := os.Open(wd.path(name))
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", false
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	db.mutex.Lock()
+	db.Files[name] = &fileRecord{Size: info.Size(), Mtime: info.ModTime(), Digest: sum}
+	db.dirty = true
+	db.mutex.Unlock()
+	return sum, true
+}
+
+// Return the record for a target, or nil if none was made.
+func (db *buildDB) target(name string) *targetRecord {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.Targets[name]
+}
+
+// Return the recipe recorded for a target, or nil if none was.
+func (db *buildDB) recipe(name string) *recipeRecord {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if tr := db.Targets[name]; tr != nil {
+		return tr.Recipe
+	}
+	return nil
+}
+
+// Return how long a target's recipe took when it last succeeded, or 0 if it
+// isn't known.
+func (db *buildDB) duration(name string) time.Duration {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if tr := db.Targets[name]; tr != nil {
+		return tr.Duration
+	}
+	return 0
+}
+
+// Remember how long a target's recipe took.
+func (db *buildDB) recordDuration(name string, d time.Duration) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	tr := db.Targets[name]
+	if tr == nil {
+		tr = &targetRecord{}
+		db.Targets[name] = tr
+	}
+	tr.Duration = d
+	db.dirty = true
+}
+
+// Remember how a target's recipe was run.
+func (db *buildDB) recordRecipe(name string, rr *recipeRecord) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	tr := db.Targets[name]
+	if tr == nil {
+		tr = &targetRecord{}
+		db.Targets[name] = tr
+	}
+	if tr.Recipe == nil || !tr.Recipe.equal(rr) {
+		tr.Recipe = rr
+		db.dirty = true
+	}
+}
+
+// Remember the current digests of a target's prerequisites.
+func (db *buildDB) recordDigests(wd *workDir, n *node, prereqs []*node) {
+	digests := make(map[string]string, len(prereqs))
+	for _, p := range prereqs {
+		if d, ok := db.digest(wd, p.name); ok {
+			digests[p.name] = d
+		}
+	}
+
+	db.mutex.Lock()
+	tr := db.Targets[n.name]
+	if tr == nil {
+		tr = &targetRecord{}
+		db.Targets[n.name] = tr
+	}
+	tr.Prereqs = digests
+	db.dirty = true
+	db.mutex.Unlock()
+}
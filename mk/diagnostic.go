@@ -0,0 +1,92 @@
+// Diagnostics: problems found in a mkfile, and where they are. The parser
+// reports every error it can recover from, rather than stopping at the first.
+
+package mk
+
+import (
+	"fmt"
+	"strings"
+)
+
+// How serious a diagnostic is.
+type Severity int
+
+const (
+	SeverityError   Severity = iota // the mkfile can't be used as written
+	SeverityWarning                 // the mkfile probably doesn't do what was meant
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// A problem found in a mkfile.
+type Diagnostic struct {
+	File     string
+	Line     int // 1-based
+	Col      int // 1-based, in runes; 0 if not known
+	Severity Severity
+	Message  string
+}
+
+// Format the diagnostic as file:line:col: message, marking warnings.
+func (d Diagnostic) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s:%d:", d.File, d.Line)
+	if d.Col > 0 {
+		fmt.Fprintf(&b, "%d:", d.Col)
+	}
+	if d.Severity == SeverityWarning {
+		b.WriteString(" warning:")
+	}
+	fmt.Fprintf(&b, " %s", d.Message)
+	return b.String()
+}
+
+// Diagnostics is the error Parse returns for a mkfile with errors in it:
+// everything found wrong, in the order it was found.
+type Diagnostics []Diagnostic
+
+func (ds Diagnostics) Error() string {
+	lines := make([]string, len(ds))
+	for i, d := range ds {
+		lines[i] = d.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Return each diagnostic as an error of its own.
+func (ds Diagnostics) Unwrap() []error {
+	errs := make([]error, len(ds))
+	for i, d := range ds {
+		errs[i] = d
+	}
+	return errs
+}
+
+// Return the diagnostics of the given severity.
+func (ds Diagnostics) withSeverity(s Severity) Diagnostics {
+	var out Diagnostics
+	for _, d := range ds {
+		if d.Severity == s {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// Report whether any of the diagnostics is an error.
+func (ds Diagnostics) hasErrors() bool {
+	for _, d := range ds {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
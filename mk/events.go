@@ -0,0 +1,83 @@
+// A log of build events, written as newline-delimited JSON for other programs
+// (CI dashboards, say) to follow a build.
+
+package mk
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// An event in the build. Fields other than Type and Time are set as they
+// apply to the event.
+type event struct {
+	Type     string     `json:"type"`
+	Time     time.Time  `json:"time"`
+	Target   string     `json:"target,omitempty"`
+	Reason   string     `json:"reason,omitempty"`    // why a target is stale, skipped or waiting
+	Recipe   string     `json:"recipe,omitempty"`    // recipe text, with variables expanded
+	Slots    []int      `json:"slots,omitempty"`     // job slots held by the recipe
+	ExitCode *int       `json:"exit_code,omitempty"` // -1 if the recipe was killed
+	Duration float64    `json:"duration,omitempty"`  // in seconds
+	Status   string     `json:"status,omitempty"`
+	Nodes    int        `json:"nodes,omitempty"`   // number of targets in the graph
+	Path     []pathStep `json:"path,omitempty"`    // the critical path
+	Work     float64    `json:"work,omitempty"`    // seconds of recipes times the slots they held
+	Minimum  float64    `json:"minimum,omitempty"` // least seconds the build could take
+}
+
+// A recipe on the critical path.
+type pathStep struct {
+	Target   string  `json:"target"`
+	Duration float64 `json:"duration"` // in seconds
+}
+
+// Event types.
+const (
+	eventGraph        = "graph"         // the dependency graph was built
+	eventNodeStart    = "node_start"    // mk began considering a target
+	eventStale        = "stale"         // a target is out of date, and why
+	eventUpToDate     = "up_to_date"    // a target needs no recipe run
+	eventSkipped      = "skipped"       // a stale target's recipe won't run
+	eventPoolWait     = "pool_wait"     // a recipe waits for room in its pool
+	eventRecipeStart  = "recipe_start"  // a recipe began running
+	eventRecipeFinish = "recipe_finish" // a recipe exited
+	eventNodeFinish   = "node_finish"   // mk is done with a target
+	eventCriticalPath = "critical_path" // the longest chain of recipes
+	eventBuildFinish  = "build_finish"  // the build is over
+)
+
+// A destination for events.
+type eventLog struct {
+	mutex sync.Mutex
+	enc   *json.Encoder
+	start time.Time // when the log was created
+}
+
+// Create an event log writing to w.
+func newEventLog(w io.Writer) *eventLog {
+	return &eventLog{enc: json.NewEncoder(w), start: time.Now()}
+}
+
+// Write an event, stamped with the current time. Does nothing if the log is
+// nil.
+func (l *eventLog) emit(ev event) {
+	if l == nil {
+		return
+	}
+	ev.Time = time.Now()
+	l.mutex.Lock()
+	l.enc.Encode(ev)
+	l.mutex.Unlock()
+}
+
+// Write the build_finish event, with the build's status. Does nothing if the
+// log is nil.
+func (l *eventLog) finish(status string) {
+	if l == nil {
+		return
+	}
+	l.emit(event{Type: eventBuildFinish, Status: status, Duration: time.Since(l.start).Seconds()})
+}
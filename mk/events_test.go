@@ -0,0 +1,39 @@
+package mk
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestEventLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := newEventLog(&buf)
+	l.emit(event{Type: eventStale, Target: "a.o", Reason: "does not exist"})
+	l.finish("ok")
+
+	data := buf.Bytes()
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d events, want 2:\n%s", len(lines), data)
+	}
+	var ev event
+	if err := json.Unmarshal([]byte(lines[0]), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != eventStale || ev.Target != "a.o" || ev.Reason != "does not exist" || ev.Time.IsZero() {
+		t.Errorf("first event = %+v", ev)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != eventBuildFinish || ev.Status != "ok" {
+		t.Errorf("last event = %+v", ev)
+	}
+
+	// A nil log discards events.
+	var nilLog *eventLog
+	nilLog.emit(event{Type: eventGraph})
+	nilLog.finish("ok")
+}
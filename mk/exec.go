@@ -0,0 +1,281 @@
+// The executor, which makes the nodes of a graph. A node's progress is kept in
+// a job, advanced in steps by a fixed pool of workers that take jobs from a
+// queue of those ready to run. A job that must wait for its prerequisites
+// counts those still being made, and goes back on the queue when the last of
+// them finishes. One that must wait for a place in a pool or for job slots
+// waits in line at the scheduler, and goes back on the queue when it is given
+// them. So no worker is tied up waiting, and jobs that need neither run.
+
+package mk
+
+import (
+	"cmp"
+	"container/heap"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Steps in making a node.
+const (
+	phaseStart = iota // pick a rule and make the prerequisites it may need
+	phaseCheck        // decide whether the node is out of date
+	phaseMake         // decide what to do if it is
+	phasePool         // take a place in the recipe's pool
+	phaseSlots        // reserve the recipe's job slots
+	phaseRun          // run the recipe
+	phaseDone
+)
+
+// A node being made.
+type job struct {
+	n        *node
+	required bool          // the node must exist, so may have to be made
+	phase    int           // the step to take next
+	pending  int           // prerequisites being made
+	failed   bool          // a prerequisite failed
+	status   nodeStatus    // status the node will finish with
+	priority time.Duration // the node's, kept here for the queue to compare
+	seq      int           // when the job was last queued
+
+	e        *edge   // the edge with the node's rule
+	prereqs  []*node // nodes its rule depends on
+	uptodate bool
+
+	waitStart time.Time     // when it began waiting for its pool and slots
+	slots     []int         // job slots held for the recipe
+	attempt   int           // times the recipe has run
+	backoff   time.Duration // waited before the last retry
+}
+
+// The jobs ready to run: the most urgent first, and among equals the last
+// queued, so that a single worker makes prerequisites depth first, in order.
+type jobQueue []*job
+
+func (q jobQueue) Len() int { return len(q) }
+
+func (q jobQueue) Less(i, j int) bool {
+	return cmp.Or(cmp.Compare(q[j].priority, q[i].priority), cmp.Compare(q[j].seq, q[i].seq)) < 0
+}
+
+func (q jobQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *jobQueue) Push(x any) { *q = append(*q, x.(*job)) }
+
+func (q *jobQueue) Pop() any {
+	old := *q
+	j := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return j
+}
+
+// Makes the nodes of a graph.
+type executor struct {
+	g     *Graph
+	opts  *buildOpts
+	root  *job // the job the build is for
+	mutex sync.Mutex
+	cond  *sync.Cond // signalled when a job is queued or the build is done
+	ready jobQueue
+	seq   int
+	done  bool
+	err   error // why the build was stopped, if it was
+}
+
+// Build a target in the graph, with as many workers as there are job slots.
+// Returns when it is built or the build is stopped, or immediately if it is
+// already being built.
+//
+// Args:
+//
+//	g: Graph in which the node lives.
+//	n: Node to (possibly) build.
+//	required: Avoid building this node, unless its prereqs are out of date.
+func mkNode(g *Graph, n *node, opts *buildOpts, required bool) error {
+	return newExecutor(g, opts).run(n, required)
+}
+
+// Create an executor for the nodes of g.
+func newExecutor(g *Graph, opts *buildOpts) *executor {
+	x := &executor{g: g, opts: opts}
+	x.cond = sync.NewCond(&x.mutex)
+	return x
+}
+
+// Build a target, as mkNode does. Returns the error the build was stopped
+// with, if it was.
+func (x *executor) run(n *node, required bool) error {
+	if n.status != nodeStatusReady && n.status != nodeStatusNop {
+		return nil
+	}
+	x.mutex.Lock()
+	x.root = x.claim(n, required)
+	x.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for range max(1, x.opts.sched.allowed) {
+		wg.Go(x.work)
+	}
+	wg.Wait()
+	return x.err
+}
+
+// Stop the build: workers finish the steps they are taking, and take no more.
+// The first error the build is stopped with is the one it returns.
+func (x *executor) stop(err error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if x.err == nil {
+		x.err = err
+	}
+	x.done = true
+	x.cond.Broadcast()
+}
+
+// Report whether the build was stopped.
+func (x *executor) stopped() bool {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return x.err != nil
+}
+
+// Take jobs from the queue and advance them, until the build is done.
+func (x *executor) work() {
+	x.mutex.Lock()
+	for {
+		for len(x.ready) == 0 && !x.done {
+			x.cond.Wait()
+		}
+		if x.done {
+			x.mutex.Unlock()
+			return
+		}
+		j := heap.Pop(&x.ready).(*job)
+		x.mutex.Unlock()
+		x.advance(j)
+		x.mutex.Lock()
+	}
+}
+
+// Take a job's steps until it finishes or must wait, for its prerequisites,
+// its pool and slots, or a retry.
+func (x *executor) advance(j *job) {
+	for {
+		switch j.phase {
+		case phaseStart:
+			if x.start(j) {
+				return
+			}
+		case phaseCheck:
+			if x.check(j) {
+				return
+			}
+		case phaseMake:
+			if x.stopped() {
+				j.status = nodeStatusFailed
+				j.phase = phaseDone
+			} else {
+				x.make(j)
+			}
+		case phasePool:
+			if x.reservePool(j) {
+				return
+			}
+		case phaseSlots:
+			if x.reserveSlots(j) {
+				return
+			}
+		case phaseRun:
+			if x.runRecipe(j) {
+				return
+			}
+		case phaseDone:
+			x.finish(j)
+			return
+		}
+	}
+}
+
+// Queue a job. Called with the executor locked.
+func (x *executor) push(j *job) {
+	x.seq++
+	j.seq = x.seq
+	heap.Push(&x.ready, j)
+	x.cond.Signal()
+}
+
+// Queue a job again, once what it waited for is done.
+func (x *executor) requeue(j *job) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.push(j)
+}
+
+// Claim a node that is ready to be made and queue a job to make it. Called
+// with the executor locked.
+func (x *executor) claim(n *node, required bool) *job {
+	n.status = nodeStatusStarted
+	j := &job{n: n, required: required, status: nodeStatusDone, priority: n.priority}
+	x.push(j)
+	return j
+}
+
+// Make the prerequisites of a job's node, required or not, and then take the
+// next step. Prerequisites already made are not made again, except those found
+// to need nothing done when they weren't required, which are made again if
+// they now are.
+// Returns true if the job must wait for some of them, in which case it is
+// queued again once they finish.
+func (x *executor) await(j *job, required bool, next int) bool {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	j.phase = next
+	// Queued last, the first prerequisites come out first.
+	for _, p := range slices.Backward(j.prereqs) {
+		if p.status == nodeStatusNop && (!required || p.flags&nodeFlagRequired != 0) {
+			continue
+		}
+		switch p.status {
+		case nodeStatusReady, nodeStatusNop:
+			x.claim(p, required)
+			fallthrough
+		case nodeStatusStarted:
+			// A prerequisite named twice is waited for once.
+			if k := len(p.dependents); k == 0 || p.dependents[k-1] != j {
+				p.dependents = append(p.dependents, j)
+				j.pending++
+			}
+		case nodeStatusFailed:
+			j.failed = true
+		}
+	}
+	return j.pending > 0
+}
+
+// Record the status a job's node finished with, and queue the jobs that were
+// waiting for it and nothing else.
+func (x *executor) finish(j *job) {
+	n := j.n
+	if n.name != "" {
+		x.opts.events.emit(event{Type: eventNodeFinish, Target: n.name, Status: j.status.String()})
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	n.status = j.status
+	if j.required {
+		n.flags |= nodeFlagRequired
+	}
+	for _, d := range n.dependents {
+		if j.status == nodeStatusFailed {
+			d.failed = true
+		}
+		if d.pending--; d.pending == 0 {
+			x.push(d)
+		}
+	}
+	n.dependents = nil
+	if j == x.root {
+		x.done = true
+		x.cond.Broadcast()
+	}
+}
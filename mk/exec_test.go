@@ -0,0 +1,100 @@
+package mk
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A mkfile of virtual targets in layers, each depending on three targets of
+// the next layer, with a recipe that is printed but, with -n, not run.
+func layeredMkfile(layers, width int) string {
+	var b strings.Builder
+	b.WriteString("all:V:")
+	for j := range width {
+		fmt.Fprintf(&b, " l0_%d", j)
+	}
+	b.WriteString("\n")
+	for i := range layers {
+		for j := range width {
+			fmt.Fprintf(&b, "l%d_%d:V:", i, j)
+			if i+1 < layers {
+				for _, k := range []int{j, (j + 1) % width, (j + 7) % width} {
+					fmt.Fprintf(&b, " l%d_%d", i+1, k)
+				}
+			}
+			b.WriteString("\n\t:\n")
+		}
+	}
+	return b.String()
+}
+
+// Time making every node of a layered graph with the given number of jobs,
+// and report the most goroutines seen at once.
+func benchmarkBuild(b *testing.B, layers, width, jobs int) {
+	rs := parse(layeredMkfile(layers, width), "mkfile", "/mkfile", map[string][]string{})
+	opts, err := newBuildOpts(rs, Options{Jobs: jobs, DryRun: true, Stdout: io.Discard})
+	if err != nil {
+		b.Fatal(err)
+	}
+	peak := 0
+	b.ReportAllocs()
+	for b.Loop() {
+		b.StopTimer()
+		g := buildgraph(rs, []string{"all"}, opts)
+		done := make(chan bool)
+		go func() {
+			for {
+				peak = max(peak, runtime.NumGoroutine())
+				select {
+				case <-done:
+					done <- true
+					return
+				case <-time.After(time.Millisecond):
+				}
+			}
+		}()
+		b.StartTimer()
+		mkNode(g, g.root, opts, true)
+		b.StopTimer()
+		done <- true
+		<-done
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(peak), "goroutines")
+}
+
+// Virtual targets without recipes, in layers of diamonds over one file, are
+// each made, with one job or several, and the build finishes.
+func TestBuildVirtualDiamonds(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("src", nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	input := strings.ReplaceAll(layeredMkfile(7, 100), "\n\t:\n", " src\n")
+	for _, jobs := range []int{1, 8} {
+		rs := parse(input, "mkfile", "/mkfile", map[string][]string{})
+		opts, err := newBuildOpts(rs, Options{Jobs: jobs, Stdout: io.Discard})
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := buildgraph(rs, []string{"all"}, opts)
+		if err := mkNode(g, g.root, opts, true); err != nil {
+			t.Fatalf("-p %d: %v", jobs, err)
+		}
+		for name, n := range g.nodes {
+			if n.status != nodeStatusDone && n.status != nodeStatusNop {
+				t.Errorf("-p %d: %s finished %v", jobs, name, n.status)
+			}
+		}
+	}
+}
+
+func BenchmarkBuildWide(b *testing.B)    { benchmarkBuild(b, 2, 5000, 8) }
+func BenchmarkBuildDeep(b *testing.B)    { benchmarkBuild(b, 10, 1000, 8) }
+func BenchmarkBuildWideSeq(b *testing.B) { benchmarkBuild(b, 2, 5000, 1) }
+func BenchmarkBuildDeepSeq(b *testing.B) { benchmarkBuild(b, 10, 1000, 1) }
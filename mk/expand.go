@@ -1,6 +1,6 @@
 // String substitution and expansion.
 
-package main
+package mk
 
 import (
 	"fmt"
@@ -11,7 +11,7 @@ import (
 )
 
 // Expand a word. This includes substituting variables and handling quotes.
-func expand(input string, vars map[string][]string, expandBackticks bool) []string {
+func expand(input string, vars map[string][]string, backticks *shellConfig) []string {
 	parts := make([]string, 0)
 	expanded := ""
 	var i, j int
@@ -36,7 +36,7 @@ func expand(input string, vars map[string][]string, expandBackticks bool) []stri
 			expanded += out
 
 		case '"':
-			out, off = expandDoubleQuoted(input[i:], vars, expandBackticks)
+			out, off = expandDoubleQuoted(input[i:], vars, backticks)
 			expanded += out
 
 		case '\'':
@@ -44,9 +44,9 @@ func expand(input string, vars map[string][]string, expandBackticks bool) []stri
 			expanded += out
 
 		case '`':
-			if expandBackticks {
+			if backticks != nil {
 				var outparts []string
-				outparts, off = expandBackQuoted(input[i:], vars)
+				outparts, off = expandBackQuoted(input[i:], vars, *backticks)
 				if len(outparts) > 0 {
 					outparts[0] = expanded + outparts[0]
 					expanded = outparts[len(outparts)-1]
@@ -98,7 +98,7 @@ func expandEscape(input string) (string, int) {
 }
 
 // Expand a double quoted string starting after a '\"'
-func expandDoubleQuoted(input string, vars map[string][]string, expandBackticks bool) (string, int) {
+func expandDoubleQuoted(input string, vars map[string][]string, backticks *shellConfig) (string, int) {
 	// find the first non-escaped "
 	i := 0
 	j := 0
@@ -113,7 +113,7 @@ func expandDoubleQuoted(input string, vars map[string][]string, expandBackticks
 		i = j + w
 
 		if c == '"' {
-			return strings.Join(expand(input[:j], vars, expandBackticks), " "), i
+			return strings.Join(expand(input[:j], vars, backticks), " "), i
 		}
 
 		if c == '\\' {
@@ -129,7 +129,7 @@ func expandDoubleQuoted(input string, vars map[string][]string, expandBackticks
 	return input, len(input)
 }
 
-// Expand a single quoted string starting after a '\''.
+// Expand a single quoted string starting after its opening quote.
 func expandSingleQuoted(input string) (string, int) {
 	j := strings.Index(input, "'")
 	if j < 0 {
@@ -171,7 +171,7 @@ func expandSigil(input string, vars map[string][]string) ([]string, int) {
 			for _, value := range values {
 				valueMatch := pat.FindStringSubmatch(value)
 				if valueMatch != nil {
-					expandedValues = append(expandedValues, expand(strings.Join([]string{c, valueMatch[1], d}, ""), vars, false)...)
+					expandedValues = append(expandedValues, expand(strings.Join([]string{c, valueMatch[1], d}, ""), vars, nil)...)
 				} else {
 					// What case is this?
 					expandedValues = append(expandedValues, value)
@@ -223,10 +223,14 @@ func expandSigil(input string, vars map[string][]string) ([]string, int) {
 	return []string{"$" + input}, len(input)
 }
 
-
-
 // Find and expand all sigils in a recipe, producing a flat string.
 func expandRecipeSigils(input string, vars map[string][]string) string {
+	return expandRecipeSigilsWith(input, vars, nil)
+}
+
+// Find and expand all sigils in a recipe, producing a flat string. The values
+// of variables defined in vars are joined by join, if not nil.
+func expandRecipeSigilsWith(input string, vars map[string][]string, join func(name string, v []string) string) string {
 	expanded := ""
 	for i := 0; i < len(input); {
 		off := strings.IndexAny(input[i:], "$\\")
@@ -241,7 +245,12 @@ func expandRecipeSigils(input string, vars map[string][]string) string {
 		if c == '$' {
 			i += w
 			ex, k := expandSigil(input[i:], vars)
-			expanded += strings.Join(ex, " ")
+			name := sigilName(input[i : i+k])
+			if _, ok := vars[name]; ok && join != nil {
+				expanded += join(name, ex)
+			} else {
+				expanded += strings.Join(ex, " ")
+			}
 			i += k
 		} else if c == '\\' {
 			i += w
@@ -262,6 +271,70 @@ func expandRecipeSigils(input string, vars map[string][]string) string {
 	return expanded
 }
 
+// Return the name of the variable in a sigil as consumed by expandSigil
+// (without the leading '$'), or "" if it doesn't name one.
+func sigilName(sigil string) string {
+	if inner, ok := strings.CutPrefix(sigil, "{"); ok {
+		inner = strings.TrimSuffix(inner, "}")
+		if i := strings.IndexByte(inner, ':'); i >= 0 {
+			inner = inner[:i]
+		}
+		sigil = strings.TrimSpace(inner)
+	}
+	if !isValidVarName(sigil) {
+		return ""
+	}
+	return sigil
+}
+
+// Return the names of the variables a recipe refers to, in order of first
+// reference. Escaped sigils ("$$" and "\$") are not references.
+func recipeVarRefs(input string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for i := 0; i < len(input); {
+		off := strings.IndexAny(input[i:], "$\\")
+		if off < 0 {
+			break
+		}
+		i += off
+		if input[i] == '\\' {
+			i += 2
+			continue
+		}
+		i++
+
+		var name string
+		if i < len(input) && input[i] == '$' {
+			i++
+			continue
+		} else if i < len(input) && input[i] == '{' {
+			j := strings.IndexAny(input[i:], ":}")
+			if j < 0 {
+				break
+			}
+			name = strings.TrimSpace(input[i+1 : i+j])
+			i += j
+		} else {
+			j := i
+			for j < len(input) {
+				c, w := utf8.DecodeRuneInString(input[j:])
+				if !(isalpha(c) || c == '_' || (j > i && isdigit(c))) {
+					break
+				}
+				j += w
+			}
+			name = input[i:j]
+			i = j
+		}
+		if isValidVarName(name) && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
 // Expand all unescaped '%' and '&' characters with the stem.
 func expandSuffixes(input string, stem string) string {
 	expanded := make([]byte, 0)
@@ -302,7 +375,7 @@ func expandSuffixes(input string, stem string) string {
 
 // Expand a backtick quoted string, by executing the contents.
 // Supports sh-style `cmd` and rc-style `{cmd}.
-func expandBackQuoted(input string, vars map[string][]string) ([]string, int) {
+func expandBackQuoted(input string, vars map[string][]string, sh shellConfig) ([]string, int) {
 	// Determine style: rc-style starts with '{', sh-style uses closing '`'
 	var cmd string
 	var consumed int
@@ -324,23 +397,24 @@ func expandBackQuoted(input string, vars map[string][]string) ([]string, int) {
 		consumed = j + 1 // cmd + '`'
 	}
 
-	env := os.Environ()
-	for key, values := range vars {
-		env = append(env, key+"="+strings.Join(values, " "))
-	}
-
 	// TODO - might have $shell available by now, but maybe not?
 	// It's not populated, regardless
 
 	var shell string
 	var shellargs []string
-	if len(vars["shell"]) < 1 {
-		shell, shellargs = expandShell(defaultShell, shellargs)
+	if vsh := varsShell(vars); len(vsh) < 1 {
+		shell, shellargs = sh.split(sh.command, shellargs)
 	} else {
-		shell, shellargs = expandShell(vars["shell"][0], shellargs)
+		shell, shellargs = sh.split(vsh[0], shellargs)
+	}
+
+	st := shellTypeOf(shell)
+	env := os.Environ()
+	for key, values := range vars {
+		env = append(env, key+"="+st.join(values))
 	}
 
-	output, ok := subprocess(shell, shellargs, env, cmd, true)
+	output, ok := subprocess(nil, shell, shellargs, env, sh.dir, cmd, true, nil)
 	if !ok {
 		mkError(fmt.Sprintf("backtick expansion failed: `%s`", cmd))
 	}
@@ -356,7 +430,7 @@ func expandBackQuoted(input string, vars map[string][]string) ([]string, int) {
 
 // Expand the shell command into cmd, args...
 // Ex. "sh -c", "pwd" becomes sh, [-c, pwd]
-func expandShell(shcmd string, args []string) (string, []string) {
+func (sh shellConfig) split(shcmd string, args []string) (string, []string) {
 	var shell string
 	var shellargs []string
 
@@ -367,7 +441,7 @@ func expandShell(shcmd string, args []string) (string, []string) {
 		shellargs = fields[1:]
 	}
 
-	if len(shellargs) > 0 && (len(args) > 0 || dontDropArgs) {
+	if len(shellargs) > 0 && (len(args) > 0 || sh.keepArgs) {
 		args = append(shellargs, args...)
 	}
 
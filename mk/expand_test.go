@@ -1,4 +1,4 @@
-package main
+package mk
 
 import (
 	"reflect"
@@ -25,7 +25,7 @@ func TestExpand(t *testing.T) {
 			want:        []string{"a"},
 		},
 		{
-			name: "literal_same_as_var",
+			name:  "literal_same_as_var",
 			input: "a",
 			vars: map[string][]string{
 				"a": {"glenda"},
@@ -34,7 +34,7 @@ func TestExpand(t *testing.T) {
 			want:        []string{"a"},
 		},
 		{
-			name: "bare_var",
+			name:  "bare_var",
 			input: "$a",
 			vars: map[string][]string{
 				"a": {"glenda"},
@@ -43,7 +43,7 @@ func TestExpand(t *testing.T) {
 			want:        []string{"glenda"},
 		},
 		{
-			name: "braced_var",
+			name:  "braced_var",
 			input: "${a}",
 			vars: map[string][]string{
 				"a": {"glenda"},
@@ -52,7 +52,7 @@ func TestExpand(t *testing.T) {
 			want:        []string{"glenda"},
 		},
 		{
-			name: "braced_var_multi",
+			name:  "braced_var_multi",
 			input: "${a}",
 			vars: map[string][]string{
 				"a": {"glenda", "gopher"},
@@ -61,7 +61,7 @@ func TestExpand(t *testing.T) {
 			want:        []string{"glenda", "gopher"},
 		},
 		{
-			name: "prefix_var",
+			name:  "prefix_var",
 			input: "ab$targetpath",
 			vars: map[string][]string{
 				"targetpath": {"./testdata"},
@@ -70,7 +70,7 @@ func TestExpand(t *testing.T) {
 			want:        []string{"ab./testdata"},
 		},
 		{
-			name: "var_suffix_mismatch",
+			name:  "var_suffix_mismatch",
 			input: "$targetpathab",
 			vars: map[string][]string{
 				"targetpath": {"./testdata"},
@@ -79,7 +79,7 @@ func TestExpand(t *testing.T) {
 			want:        []string{"$targetpathab"},
 		},
 		{
-			name: "var_slash_suffix",
+			name:  "var_slash_suffix",
 			input: "$targetpath/foo",
 			vars: map[string][]string{
 				"targetpath": {"./testdata"},
@@ -88,7 +88,7 @@ func TestExpand(t *testing.T) {
 			want:        []string{"./testdata/foo"},
 		},
 		{
-			name: "braced_var_slash_suffix",
+			name:  "braced_var_slash_suffix",
 			input: "${targetpath}/foo",
 			vars: map[string][]string{
 				"targetpath": {"./testdata"},
@@ -98,7 +98,7 @@ func TestExpand(t *testing.T) {
 		},
 		{
 			// Differs from p9p mk: double quotes strip here.
-			name: "double_quoted_var",
+			name:  "double_quoted_var",
 			input: "\"$targetpath\"",
 			vars: map[string][]string{
 				"targetpath": {"./testdata"},
@@ -107,7 +107,7 @@ func TestExpand(t *testing.T) {
 			want:        []string{"./testdata"},
 		},
 		{
-			name: "double_quoted_prefix_var",
+			name:  "double_quoted_prefix_var",
 			input: "\"s3://$targetpath\"",
 			vars: map[string][]string{
 				"targetpath": {"testdata"},
@@ -116,7 +116,7 @@ func TestExpand(t *testing.T) {
 			want:        []string{"s3://testdata"},
 		},
 		{
-			name: "single_quoted_var",
+			name:  "single_quoted_var",
 			input: "'$targetpath'",
 			vars: map[string][]string{
 				"targetpath": {"./testdata"},
@@ -125,7 +125,7 @@ func TestExpand(t *testing.T) {
 			want:        []string{"$targetpath"},
 		},
 		{
-			name: "multi_var_dot",
+			name:  "multi_var_dot",
 			input: "$prefix.$suffix",
 			vars: map[string][]string{
 				"prefix": {"name"},
@@ -135,7 +135,7 @@ func TestExpand(t *testing.T) {
 			want:        []string{"name.o"},
 		},
 		{
-			name: "namelist_subst",
+			name:  "namelist_subst",
 			input: "${targets:%=$targetpath/%}",
 			vars: map[string][]string{
 				"targetpath": {"./testdata"},
@@ -145,7 +145,7 @@ func TestExpand(t *testing.T) {
 			want:        []string{"./testdata/rupert", "./testdata/ruxpin"},
 		},
 		{
-			name: "namelist_missing_var",
+			name:  "namelist_missing_var",
 			input: "${targets:%=%.$novar}",
 			vars: map[string][]string{
 				"suffixes": {"o", "ab", "b"},
@@ -155,7 +155,7 @@ func TestExpand(t *testing.T) {
 			want:        []string{"rupert.$novar", "ruxpin.$novar"},
 		},
 		{
-			name: "namelist_multi_value",
+			name:  "namelist_multi_value",
 			input: "${targets:%=%.$suffixes}",
 			vars: map[string][]string{
 				"suffixes": {"teddy", "ab", "b"},
@@ -172,7 +172,7 @@ func TestExpand(t *testing.T) {
 			},
 		},
 		{
-			name: "namelist_single_suffix",
+			name:  "namelist_single_suffix",
 			input: "${targets:%=%.$suffixes}",
 			vars: map[string][]string{
 				"suffixes": {"adventure"},
@@ -241,7 +241,7 @@ func TestExpand(t *testing.T) {
 			want:        []string{"$nonexistent_var_xyz"},
 		},
 		{
-			name: "namelist_partial_match",
+			name:  "namelist_partial_match",
 			input: "${targets:foo%=bar%}",
 			vars: map[string][]string{
 				"targets": {"fooX", "other"},
@@ -253,7 +253,11 @@ func TestExpand(t *testing.T) {
 
 	for _, tv := range tests {
 		t.Run(tv.name, func(t *testing.T) {
-			got := expand(tv.input, tv.vars, tv.expandticks)
+			var backticks *shellConfig
+			if tv.expandticks {
+				backticks = &shellConfig{command: defaultShell}
+			}
+			got := expand(tv.input, tv.vars, backticks)
 			if !reflect.DeepEqual(got, tv.want) {
 				t.Errorf("input: %#v, vars: %s, ticks: %v\n  got  %s\n  want %s",
 					tv.input, litter.Sdump(tv.vars), tv.expandticks,
@@ -333,7 +337,7 @@ func TestExpandDoubleQuotedEdgeCases(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, n := expandDoubleQuoted(tt.input, map[string][]string{}, false)
+			got, n := expandDoubleQuoted(tt.input, map[string][]string{}, nil)
 			if got != tt.want || n != tt.wantN {
 				t.Errorf("expandDoubleQuoted(%q) = (%q, %d), want (%q, %d)",
 					tt.input, got, n, tt.want, tt.wantN)
@@ -374,7 +378,7 @@ func TestExpandBackQuotedEdgeCases(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, n := expandBackQuoted(tt.input, map[string][]string{"shell": {"sh"}})
+			got, n := expandBackQuoted(tt.input, map[string][]string{"shell": {"sh"}}, shellConfig{command: defaultShell})
 			if !reflect.DeepEqual(got, tt.want) || n != tt.wantN {
 				t.Errorf("expandBackQuoted(%q) = (%v, %d), want (%v, %d)",
 					tt.input, got, n, tt.want, tt.wantN)
@@ -418,20 +422,20 @@ func TestExpandSuffixes(t *testing.T) {
 func TestExpandSigilEnvLookup(t *testing.T) {
 	// Valid varname not in vars but in env → env lookup path
 	t.Setenv("MK_TEST_ENV_VAR_XYZ", "envvalue")
-	got := expand("$MK_TEST_ENV_VAR_XYZ", map[string][]string{}, false)
+	got := expand("$MK_TEST_ENV_VAR_XYZ", map[string][]string{}, nil)
 	if len(got) != 1 || got[0] != "envvalue" {
 		t.Errorf("expand env var: got %v, want [envvalue]", got)
 	}
 
 	// Bracketed invalid varname in env
 	t.Setenv("1bad", "badval")
-	got = expand("${1bad}", map[string][]string{}, false)
+	got = expand("${1bad}", map[string][]string{}, nil)
 	if len(got) != 1 || got[0] != "badval" {
 		t.Errorf("expand invalid varname in env: got %v, want [badval]", got)
 	}
 
 	// Bracketed invalid varname not in env
-	got = expand("${2nonexistent_xyzzy}", map[string][]string{}, false)
+	got = expand("${2nonexistent_xyzzy}", map[string][]string{}, nil)
 	if len(got) != 1 || got[0] != "${2nonexistent_xyzzy}" {
 		t.Errorf("expand invalid varname not in env: got %v, want [${2nonexistent_xyzzy}]", got)
 	}
@@ -454,7 +458,7 @@ func TestExpandBackQuoted(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, _ := expandBackQuoted(tt.input, tt.vars)
+			got, _ := expandBackQuoted(tt.input, tt.vars, shellConfig{command: defaultShell})
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("expandBackQuoted(%q)\n  got  %s\n  want %s",
 					tt.input, litter.Sdump(got), litter.Sdump(tt.want))
@@ -462,3 +466,29 @@ func TestExpandBackQuoted(t *testing.T) {
 		})
 	}
 }
+
+func TestRecipeVarRefs(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"bare", "cc $CFLAGS -o $target", []string{"CFLAGS", "target"}},
+		{"braced", "echo ${a}b", []string{"a"}},
+		{"namelist", "echo ${SRC:%.c=%.o}", []string{"SRC"}},
+		{"repeated", "$a $a $b", []string{"a", "b"}},
+		{"dollar_escape", "echo $$HOME", nil},
+		{"backslash_escape", `echo \$HOME`, nil},
+		{"not_a_name", "echo $(pwd) $1", nil},
+		{"unterminated_brace", "echo ${a", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := recipeVarRefs(tt.input)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("recipeVarRefs(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
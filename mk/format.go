@@ -0,0 +1,220 @@
+// Formatting mkfiles in a canonical style: assignments as name=value, rule
+// headers as targets:attributes: prerequisites, words separated by a space,
+// continuation lines indented by a tab, recipes indented by a tab, and no more
+// than one blank line in a row. Comments and line breaks between words are
+// kept.
+
+package mk
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Format a mkfile in the canonical style. The mkfile is parsed before and
+// after, and it is an error if it can't be or if the two parses differ: the
+// style may change but the meaning must not. The parses run nothing and read
+// no includes: backticks are left as they are written and includes are only
+// noted, so the result doesn't depend on what they would give.
+func Format(input, name string) (out string, err error) {
+	defer recoverFatal(&err)
+	f := ParseSyntax(input, name)
+	var diags Diagnostics
+	for _, s := range f.Stmts {
+		if s, ok := s.(*BadStmt); ok {
+			diags = append(diags, Diagnostic{
+				File:     name,
+				Line:     s.Pos().Line,
+				Col:      s.Pos().Col,
+				Severity: SeverityError,
+				Message:  "syntax error",
+			})
+		}
+	}
+	if len(diags) > 0 {
+		return "", diags
+	}
+	rs := parseUnrun(input, name)
+	if rs.diags.hasErrors() {
+		return "", rs.diags
+	}
+	out = formatSyntax(f)
+	if rs2 := parseUnrun(out, name); rs2.diags.hasErrors() || !rs.equivalent(rs2) {
+		return "", fmt.Errorf("%s: formatting would change the meaning of the mkfile", name)
+	}
+	return out, nil
+}
+
+// Parse a mkfile without running anything or reading its includes.
+func parseUnrun(input, name string) *RuleSet {
+	return parseWith(input, name, name, make(map[string][]string), shellConfig{command: defaultShell, norun: true})
+}
+
+// Report whether two rule sets have the same variables, rules and includes,
+// wherever they were defined.
+func (rs *RuleSet) equivalent(rs2 *RuleSet) bool {
+	if len(rs.vars) != len(rs2.vars) || len(rs.rules) != len(rs2.rules) ||
+		!maps.Equal(rs.unexportedVars, rs2.unexportedVars) || !slices.Equal(rs.unread, rs2.unread) {
+		return false
+	}
+	for k, v := range rs.vars {
+		if v2, ok := rs2.vars[k]; !ok || !slices.Equal(v, v2) {
+			return false
+		}
+	}
+	for i := range rs.rules {
+		r, r2 := &rs.rules[i], &rs2.rules[i]
+		if !r.sameHeader(r2) || !r.equivRecipe(r2) || !slices.Equal(r.command, r2.command) {
+			return false
+		}
+	}
+	return true
+}
+
+// Return how far a recipe's first line is indented.
+func recipeIndent(r *Recipe) int {
+	return len(r.Text) - len(strings.TrimLeft(r.Text, " \t\r"))
+}
+
+// Write the syntax tree of a mkfile in the canonical style.
+func formatSyntax(f *File) string {
+	var b strings.Builder
+	blank := false
+	for _, s := range f.Stmts {
+		if _, ok := s.(*Blank); ok {
+			blank = true
+			continue
+		}
+		if blank && b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		blank = false
+
+		switch s := s.(type) {
+		case *Comment:
+			b.WriteString(formatComment(s))
+		case *Assignment:
+			b.WriteString(s.Name.Text)
+			if s.Unexported {
+				b.WriteString("=U=")
+			} else {
+				b.WriteString("=")
+			}
+			formatWords(&b, s.Name.End(), "", s.Value)
+			formatTrailingComment(&b, s.Comment)
+		case *Include:
+			if s.Pipe {
+				b.WriteString("<|")
+			} else {
+				b.WriteString("<")
+			}
+			formatWords(&b, s.Pos(), "", s.Args)
+			formatTrailingComment(&b, s.Comment)
+		case *Rule:
+			end := formatWords(&b, s.Pos(), "", s.Targets)
+			b.WriteString(":")
+			if attribs := formatAttributes(s.Attributes); len(attribs) > 0 {
+				b.WriteString(strings.Join(attribs, " "))
+				b.WriteString(":")
+				end = s.Attributes[len(s.Attributes)-1].End()
+			}
+			formatWords(&b, end, " ", s.Prereqs)
+			formatTrailingComment(&b, s.Comment)
+			if s.Recipe != nil {
+				formatRecipe(&b, s.Recipe)
+			}
+		default:
+			// Parse found nothing wrong, so there shouldn't be anything
+			// else, but if there is it's kept as it is.
+			text := f.Text(s)
+			b.WriteString(text)
+			if !strings.HasSuffix(text, "\n") {
+				b.WriteString("\n")
+			}
+		}
+	}
+	return b.String()
+}
+
+// Write words separated by spaces, first preceded by sep. A word on a later
+// line than the one before it, the first after prev, goes on a continuation
+// line. Return where the last word ends.
+func formatWords(b *strings.Builder, prev Pos, sep string, words []Word) Pos {
+	for _, w := range words {
+		if w.Pos().Line > prev.Line {
+			b.WriteString(" \\\n\t")
+		} else {
+			b.WriteString(sep)
+		}
+		b.WriteString(w.Text)
+		prev, sep = w.End(), " "
+	}
+	return prev
+}
+
+// Write the comment at the end of a line, if there is one, and the newline.
+func formatTrailingComment(b *strings.Builder, c *Comment) {
+	if c != nil {
+		b.WriteString(" ")
+		b.WriteString(strings.TrimSuffix(formatComment(c), "\n"))
+	}
+	b.WriteString("\n")
+}
+
+// Return a comment's line, without trailing white space unless that would
+// continue it onto the next line.
+func formatComment(c *Comment) string {
+	text := strings.TrimRight(c.Text, " \t\r")
+	if strings.HasSuffix(text, "\\") {
+		text = c.Text
+	}
+	return text + "\n"
+}
+
+// The flags among attributes, in the order they're written in.
+const attributeFlags = "DEHNQRUVXn"
+
+// Return a rule's attributes with its flags in order and each only once, as
+// in QV for VQ V. Words with anything but flags in them, and those following,
+// are left as they are.
+func formatAttributes(attribs []Word) []string {
+	var flags []byte
+	var rest []string
+	for i, w := range attribs {
+		if strings.Trim(w.Text, attributeFlags) != "" {
+			for _, w := range attribs[i:] {
+				rest = append(rest, w.Text)
+			}
+			break
+		}
+		flags = append(flags, w.Text...)
+	}
+	slices.Sort(flags)
+	flags = slices.Compact(flags)
+	if len(flags) > 0 {
+		rest = append([]string{string(flags)}, rest...)
+	}
+	return rest
+}
+
+// Write a recipe indented by a tab. Each line loses the indentation the
+// parser strips from it, as much as the first line's, and gains a tab, which
+// is all the parser strips from the result.
+func formatRecipe(b *strings.Builder, r *Recipe) {
+	indent := recipeIndent(r)
+	for line := range strings.Lines(r.Text) {
+		text := stripIndentation(line, indent)
+		if text == "" {
+			// A blank line, which the parser drops.
+			b.WriteString("\n")
+			continue
+		}
+		b.WriteString("\t")
+		b.WriteString(text)
+		if !strings.HasSuffix(text, "\n") {
+			b.WriteString("\n")
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package mk
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"empty", "", ""},
+		{"assignment", "CC = gcc  -O2\nX =U= a\n", "CC=gcc -O2\nX=U=a\n"},
+		{"rule", "all :V:  a b\n", "all:V: a b\n"},
+		{"no prereqs", "all:V:\n", "all:V:\n"},
+		{"empty attributes", "a:: b\n", "a: b\n"},
+		{"attribute order", "a:VQ V: b\n", "a:QV: b\n"},
+		{"attribute with argument", "a:V Lnet: b\n", "a:V Lnet: b\n"},
+		{"shell attribute", "a:Ssh -x: b\n\techo\n", "a:Ssh -x: b\n\techo\n"},
+		{"recipe spaces", "a:\n    echo a\n      echo b\n", "a:\n\techo a\n\t  echo b\n"},
+		{"recipe tab and spaces", "a:\n\t\techo a\n\t\t\techo b\n", "a:\n\techo a\n\t\techo b\n"},
+		{"recipe blank lines", "a:\n\techo a\n\n\techo b\n", "a:\n\techo a\n\n\techo b\n"},
+		{"blank lines", "\n\nX=1\n\n\n\nY=2\n\n\n", "X=1\n\nY=2\n"},
+		{"comments", "# top   \nX=1   # one  \n", "# top\nX=1 # one\n"},
+		{"comment continued", "# a \\\n  b\nX=1\n", "# a \\\n  b\nX=1\n"},
+		{"continuation", "a: b \\\n      c \\\n  d\n", "a: b \\\n\tc \\\n\td\n"},
+		{"continued value", "X=\\\n  a b\n", "X= \\\n\ta b\n"},
+		{"include", "<  inc.mk\n<| echo X=1\n", "<inc.mk\n<|echo X=1\n"},
+		{"no final newline", "a:\n\techo a", "a:\n\techo a\n"},
+		{"adjacent words", "X=a=b c'd e'\n", "X=a=b c'd e'\n"},
+		{"backtick", "N = `date +%N`\n", "N=`date +%N`\n"},
+		{"backtick in recipe", "a:\n    echo `date +%N`\n", "a:\n\techo `date +%N`\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Format(tt.in, "mkfile")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Format(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			again, err := Format(got, "mkfile")
+			if err != nil || again != got {
+				t.Errorf("formatting again gives %q, %v", again, err)
+			}
+		})
+	}
+}
+
+func TestFormatError(t *testing.T) {
+	_, err := Format("a: b\n:\n", "mkfile")
+	if err == nil || err.Error() != "mkfile:2:1: syntax error" {
+		t.Errorf("formatting a mkfile with a syntax error gives %v", err)
+	}
+}
+
+// Formatting runs neither backticks nor pipe includes, and reads no includes.
+func TestFormatRunsNothing(t *testing.T) {
+	t.Chdir(t.TempDir())
+	in := "X=`touch backtick`\n<|touch pipe\n<missing.mk\n"
+	if _, err := Format(in, "mkfile"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"backtick", "pipe"} {
+		if _, err := os.Stat(name); err == nil {
+			t.Errorf("formatting ran the command making %s", name)
+		}
+	}
+}
+
+// Format every mkfile in the script tests, which Format checks means the
+// same as before.
+func TestFormatTestdata(t *testing.T) {
+	paths, err := filepath.Glob("../testdata/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range paths {
+		paths[i], _ = filepath.Abs(paths[i])
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sec := range strings.Split(string(data), "\n-- ")[1:] {
+			name, body, _ := strings.Cut(sec, " --\n")
+			if name != "mkfile" || parseUnrun(body, name).diags.hasErrors() {
+				continue // the test is of the error
+			}
+			if _, err := Format(body, path); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+// Rule sets parsed without running anything are compared by what they mean.
+func TestEquivalent(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"X = a  b\na:V: b c\n\techo $X\n", "X=a b\na:V: \\\n\tb c\n\techo $X\n", true},
+		{"a:V Lnet: b\n", "a:VLnet: b\n", true},
+		{"a:Lnet V: b\n", "a:Lnet: b\n", false},
+		{"a:Snet: b\n\techo\n", "a:Snet V: b\n\techo\n", false},
+		{"X=`echo a`\n", "X=`echo  a`\n", false},
+		{"<inc.mk\n<|echo X=1\n", "<inc.mk\n<|echo X=1\n", true},
+		{"<|echo X=1\n", "<|echo X=2\n", false},
+		{"X=a\n", "X=U=a\n", false},
+	}
+	for _, tt := range tests {
+		rs, rs2 := parseUnrun(tt.a, "mkfile"), parseUnrun(tt.b, "mkfile")
+		if rs.diags.hasErrors() || rs2.diags.hasErrors() {
+			t.Fatalf("parsing %q and %q: %v, %v", tt.a, tt.b, rs.diags, rs2.diags)
+		}
+		if got := rs.equivalent(rs2); got != tt.want {
+			t.Errorf("equivalent(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,609 @@
+package mk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A dependency graph, made by BuildGraph.
+type Graph struct {
+	root       *node            // the intial target's node
+	nodes      map[string]*node // map targets to their nodes
+	wd         *workDir         // where the targets' files are
+	rebuildall bool             // -a flag: ignore timestamps, rebuild everything
+	maxrulecnt int              // times a rule may be applied in a chain (-l)
+}
+
+// An edge in the graph.
+type edge struct {
+	v       *node    // node this edge directs to
+	stem    string   // stem matched for meta-rule applications
+	matches []string // regular expression matches
+	togo    bool     // this edge is going to be pruned
+	r       *rule
+}
+
+// Current status of a node in the build.
+type nodeStatus int
+
+const (
+	nodeStatusReady nodeStatus = iota
+	nodeStatusStarted
+	nodeStatusNop
+	nodeStatusDone
+	nodeStatusFailed
+)
+
+func (s nodeStatus) String() string {
+	switch s {
+	case nodeStatusReady:
+		return "ready"
+	case nodeStatusStarted:
+		return "started"
+	case nodeStatusNop:
+		return "nop"
+	case nodeStatusDone:
+		return "done"
+	case nodeStatusFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("nodeStatus(%d)", int(s))
+}
+
+type nodeFlag int
+
+const (
+	nodeFlagCycle      nodeFlag = 0x0002
+	nodeFlagReady      nodeFlag = 0x0004
+	nodeFlagProbable   nodeFlag = 0x0100
+	nodeFlagVacuous    nodeFlag = 0x0200
+	nodeFlagForcedTime nodeFlag = 0x0400 // timestamp set by -w; don't overwrite
+	nodeFlagMember     nodeFlag = 0x0800 // timestamp read from an archive
+	nodeFlagRequired   nodeFlag = 0x1000 // made when required
+)
+
+// A node in the dependency graph
+type node struct {
+	r          *rule         // rule to be applied
+	name       string        // target name
+	t          time.Time     // file modification time
+	exists     bool          // does a non-virtual target exist
+	prereqs    []*edge       // prerequisite rules
+	status     nodeStatus    // current state of the node in the build
+	dependents []*job        // jobs waiting for the node to be made
+	flags      nodeFlag      // bitwise combination of node flags
+	run        *recipeRun    // outcome of the node's recipe, once it has run
+	priority   time.Duration // estimated time from its recipe's start to the build's end
+}
+
+// The directory a build works in, where the files its targets name are.
+type workDir struct {
+	dir      string  // "" for the process's working directory
+	archives arCache // archives whose members have been read
+}
+
+// Return the path of a file named relative to the directory.
+func (w *workDir) path(name string) string {
+	if w.dir == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(w.dir, name)
+}
+
+// Update a node's timestamp and 'exists' flag.
+func (n *node) updateTimestamp(wd *workDir, rebuildall bool) {
+	if n.flags&nodeFlagForcedTime != 0 {
+		return
+	}
+	n.flags &^= nodeFlagMember
+	info, err := os.Stat(wd.path(n.name))
+	if err == nil {
+		n.t = info.ModTime()
+		n.exists = true
+		n.flags |= nodeFlagProbable
+	} else if t, ok := n.memberTime(wd); ok {
+		n.t = t
+		n.exists = true
+		n.flags |= nodeFlagProbable | nodeFlagMember
+	} else {
+		n.t = time.Unix(0, 0)
+		n.exists = false
+	}
+
+	if rebuildall {
+		n.flags |= nodeFlagProbable
+	}
+}
+
+// Return the archive's time for a node naming an archive member, lib(member).
+func (n *node) memberTime(wd *workDir) (time.Time, bool) {
+	archive, member, ok := splitMember(n.name)
+	if !ok {
+		return time.Time{}, false
+	}
+	return wd.memberTime(archive, member)
+}
+
+// Create a new node
+func (g *Graph) newnode(name string) *node {
+	n := &node{name: name}
+	n.updateTimestamp(g.wd, g.rebuildall)
+	g.nodes[name] = n
+	return n
+}
+
+// Print a graph in graphviz format.
+func (g *Graph) visualize(w io.Writer) {
+	fmt.Fprintln(w, "digraph mk {")
+	targets := make([]string, 0, len(g.nodes))
+	for t := range g.nodes {
+		targets = append(targets, t)
+	}
+	slices.Sort(targets)
+	for _, t := range targets {
+		n := g.nodes[t]
+		for i := range n.prereqs {
+			if n.prereqs[i].v != nil {
+				fmt.Fprintf(w, "    \"%s\" -> \"%s\";\n", t, n.prereqs[i].v.name)
+			}
+		}
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// Create a new arc.
+func (n *node) newedge(v *node, r *rule) *edge {
+	e := &edge{v: v, r: r}
+	n.prereqs = append(n.prereqs, e)
+	return e
+}
+
+// Create a dependency graph for the given targets, whose root is a virtual
+// node depending on them all. If there are cycles, report the first, or all of
+// them with -k.
+func buildgraph(rs *RuleSet, targets []string, opts *buildOpts) *Graph {
+	g := &Graph{nodes: make(map[string]*node), wd: opts.wd, rebuildall: opts.RebuildAll, maxrulecnt: opts.MaxRuleCount}
+
+	// keep track of how many times each rule is visited, to avoid cycles.
+	rulecnt := make([]int, len(rs.rules))
+	root := &rule{targets: []pattern{{spat: ""}}, attributes: attribSet{virtual: true}, prereqs: targets}
+	g.root = g.newnode("")
+	for _, t := range targets {
+		g.root.newedge(applyrules(rs, g, t, rulecnt), root)
+	}
+	if errs := g.cycles(opts.KeepGoing); len(errs) > 0 {
+		panic(fatalError{errors.Join(errs...)})
+	}
+	g.root.flags |= nodeFlagProbable
+	g.vacuous(g.root)
+	g.ambiguous(g.root, opts)
+
+	return g
+}
+
+// Recursively match the given target to a rule in the rule set to construct the
+// full graph.
+func applyrules(rs *RuleSet, g *Graph, target string, rulecnt []int) *node {
+	n, ok := g.nodes[target]
+	if ok {
+		return n
+	}
+	n = g.newnode(target)
+
+	// does the target match a concrete rule?
+
+	ks, ok := rs.targetrules[target]
+	if ok {
+		for ki := range ks {
+			k := ks[ki]
+			// Use > (not >=) so multi-target rules like "a b: b" can match
+			// each target once before the limit kicks in. Metarules use >=.
+			if rulecnt[k] > g.maxrulecnt {
+				continue
+			}
+
+			r := &rs.rules[k]
+
+			// skip meta-rules
+			if r.ismeta {
+				continue
+			}
+
+			// skip rules that have no effect (but keep N-attributed rules)
+			if r.recipe == "" && len(r.prereqs) == 0 && !r.attributes.forcedTimestamp {
+				continue
+			}
+
+			n.flags |= nodeFlagProbable
+			rulecnt[k] += 1
+			if len(r.prereqs) == 0 {
+				n.newedge(nil, r)
+			} else {
+				for i := range r.prereqs {
+					n.newedge(applyrules(rs, g, r.prereqs[i], rulecnt), r)
+				}
+			}
+			rulecnt[k] -= 1
+		}
+	}
+
+	// find applicable metarules
+	for _, m := range rs.meta.candidates(target) {
+		k := m.rule
+		if rulecnt[k] >= g.maxrulecnt {
+			continue
+		}
+
+		r := &rs.rules[k]
+
+		// skip rules that have no effect (but keep N-attributed rules)
+		if r.recipe == "" && len(r.prereqs) == 0 && !r.attributes.forcedTimestamp {
+			continue
+		}
+
+		// n attribute: skip metarule if the target is virtual-only
+		// (doesn't exist on disk and no concrete rule matched)
+		if r.attributes.nonvirtual && !n.exists && n.flags&nodeFlagProbable == 0 {
+			continue
+		}
+
+		mat := r.targets[m.target].match(target)
+		if mat == nil {
+			continue
+		}
+
+		var stem string
+		var matches []string
+		matchVars := make(map[string][]string)
+
+		if r.attributes.regex {
+			matches = mat
+			for i := range matches {
+				key := fmt.Sprintf("stem%d", i)
+				matchVars[key] = matches[i : i+1]
+			}
+		} else if len(mat) > 1 {
+			stem = mat[1]
+		}
+
+		rulecnt[k] += 1
+		if len(r.prereqs) == 0 {
+			e := n.newedge(nil, r)
+			e.stem = stem
+			e.matches = matches
+		} else {
+			for i := range r.prereqs {
+				var prereq string
+				if r.attributes.regex {
+					prereq = expandRecipeSigils(r.prereqs[i], matchVars)
+				} else {
+					prereq = expandSuffixes(r.prereqs[i], stem)
+				}
+
+				e := n.newedge(applyrules(rs, g, prereq, rulecnt), r)
+				e.stem = stem
+				e.matches = matches
+			}
+		}
+		rulecnt[k] -= 1
+	}
+
+	return n
+}
+
+// Remove edges marked for pruning (edge.togo == true).
+func (g *Graph) pruneEdges(n *node) {
+	count := 0
+	for i := range n.prereqs {
+		if !n.prereqs[i].togo {
+			count++
+		}
+	}
+	prereqs := make([]*edge, count)
+	j := 0
+	for i := range n.prereqs {
+		if !n.prereqs[i].togo {
+			prereqs[j] = n.prereqs[i]
+			j++
+		}
+	}
+
+	// TODO: We may have to delete nodes from g.nodes, right?
+
+	n.prereqs = prereqs
+}
+
+// Remove vacous children of n.
+func (g *Graph) vacuous(n *node) bool {
+	vac := n.flags&nodeFlagProbable == 0
+	if n.flags&nodeFlagReady != 0 {
+		return vac
+	}
+	n.flags |= nodeFlagReady
+
+	for i := range n.prereqs {
+		e := n.prereqs[i]
+		if e.v != nil && g.vacuous(e.v) && e.r.ismeta {
+			e.togo = true
+		} else {
+			vac = false
+		}
+	}
+
+	// if a rule generated edges that are not togo, keep all of its edges
+	for i := range n.prereqs {
+		e := n.prereqs[i]
+		if !e.togo {
+			for j := range n.prereqs {
+				f := n.prereqs[j]
+				if e.r == f.r {
+					f.togo = false
+				}
+			}
+		}
+	}
+
+	g.pruneEdges(n)
+	if vac {
+		n.flags |= nodeFlagVacuous
+	}
+
+	return vac
+}
+
+// The most cycles reported in one strongly connected component of the graph.
+const maxCycles = 10
+
+// Return an error describing each cycle in the graph, or the first alone unless
+// all is set. Cycles are found by first finding the strongly connected
+// components of the graph, then enumerating the cycles within each, at most
+// maxCycles of them, so that the search takes time in proportion to the size
+// of the graph and the number of cycles reported.
+func (g *Graph) cycles(all bool) []error {
+	var errs []error
+	for _, comp := range g.components() {
+		limit := maxCycles
+		if !all {
+			limit = 1
+		}
+		found := componentCycles(comp, limit+1)
+		for _, c := range found[:min(len(found), limit)] {
+			errs = append(errs, cycleError(c.v, c.edges))
+		}
+		if !all {
+			break
+		}
+		if len(found) > limit {
+			errs = append(errs, fmt.Errorf("more cycles through target %s not reported", comp[0].name))
+		}
+	}
+	return errs
+}
+
+// The state of Tarjan's search for strongly connected components.
+type componentSearch struct {
+	index map[*node]int // order in which nodes were reached
+	low   map[*node]int // least index reachable from each node's subtree
+	stack []*node       // nodes not yet assigned to a component
+	comps [][]*node
+}
+
+// Return the strongly connected components of the graph reachable from its
+// root that have cycles, in the order they were reached, each with its nodes
+// in the order they were reached.
+func (g *Graph) components() [][]*node {
+	cs := &componentSearch{index: make(map[*node]int), low: make(map[*node]int)}
+	cs.visit(g.root)
+	// Components are completed in reverse topological order.
+	slices.SortFunc(cs.comps, func(a, b []*node) int { return cs.index[a[0]] - cs.index[b[0]] })
+	return cs.comps
+}
+
+// Visit n and the nodes reachable from it, completing the components whose
+// first node is among them. Nodes on the stack are flagged nodeFlagCycle.
+func (cs *componentSearch) visit(n *node) {
+	cs.index[n] = len(cs.index)
+	cs.low[n] = cs.index[n]
+	cs.stack = append(cs.stack, n)
+	n.flags |= nodeFlagCycle
+	selfLoop := false
+	for _, e := range n.prereqs {
+		v := e.v
+		if v == nil {
+			continue
+		}
+		if _, ok := cs.index[v]; !ok {
+			cs.visit(v)
+			cs.low[n] = min(cs.low[n], cs.low[v])
+		} else if v.flags&nodeFlagCycle != 0 {
+			cs.low[n] = min(cs.low[n], cs.index[v])
+		}
+		selfLoop = selfLoop || v == n
+	}
+	if cs.low[n] != cs.index[n] {
+		return
+	}
+	i := len(cs.stack) - 1
+	for cs.stack[i] != n {
+		i--
+	}
+	comp := slices.Clone(cs.stack[i:])
+	cs.stack = cs.stack[:i]
+	for _, v := range comp {
+		v.flags &^= nodeFlagCycle
+	}
+	if len(comp) > 1 || selfLoop {
+		cs.comps = append(cs.comps, comp)
+	}
+}
+
+// A cycle: the edges leading from v back to it.
+type cycle struct {
+	v     *node
+	edges []*edge
+}
+
+// Return up to limit of the cycles in comp, a strongly connected component,
+// by Johnson's algorithm. Each is found once, starting at whichever of its
+// nodes comes first in comp. A node from which the start can't be reached is
+// blocked until a cycle is found through a node it leads to, so the search
+// takes time in proportion to the size of comp and the number found.
+func componentCycles(comp []*node, limit int) []cycle {
+	order := make(map[*node]int, len(comp))
+	for i, n := range comp {
+		order[n] = i
+	}
+	var found []cycle
+	seen := make(map[string]bool) // cycles found, by their edges
+	for si, s := range comp {
+		blocked := make(map[*node]bool)
+		blockers := make(map[*node][]*node) // nodes to unblock with each node
+		var path []*edge
+
+		// Whether an edge to v stays within the nodes still searched.
+		within := func(v *node) bool {
+			i, ok := order[v]
+			return ok && i >= si
+		}
+		var unblock func(n *node)
+		unblock = func(n *node) {
+			blocked[n] = false
+			for _, w := range blockers[n] {
+				if blocked[w] {
+					unblock(w)
+				}
+			}
+			blockers[n] = nil
+		}
+		var circuit func(n *node) bool
+		circuit = func(n *node) bool {
+			closed := false
+			blocked[n] = true
+			for _, e := range n.prereqs {
+				if len(found) >= limit {
+					break
+				}
+				if e.v == nil || !within(e.v) {
+					continue
+				}
+				path = append(path, e)
+				if e.v == s {
+					closed = true
+					if key := cycleKey(s, path); !seen[key] {
+						seen[key] = true
+						found = append(found, cycle{s, slices.Clone(path)})
+					}
+				} else if !blocked[e.v] && circuit(e.v) {
+					closed = true
+				}
+				path = path[:len(path)-1]
+			}
+			if closed {
+				unblock(n)
+			} else {
+				for _, e := range n.prereqs {
+					if e.v != nil && within(e.v) && !slices.Contains(blockers[e.v], n) {
+						blockers[e.v] = append(blockers[e.v], n)
+					}
+				}
+			}
+			return closed
+		}
+		circuit(s)
+		if len(found) >= limit {
+			break
+		}
+	}
+	return found
+}
+
+// Return a key identifying a cycle by its edges, whichever node it was
+// entered at.
+func cycleKey(v *node, cycle []*edge) string {
+	pairs := make([]string, len(cycle))
+	from := v
+	for i, e := range cycle {
+		pairs[i] = from.name + "\x00" + e.v.name
+		from = e.v
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, "\n")
+}
+
+// Describe a cycle, the edges leading from v back to it, with the rule that
+// introduced each edge, as in an ambiguity trace.
+func cycleError(v *node, cycle []*edge) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "cycle in the graph detected at target %s\n\t%s", v.name, v.name)
+	for _, e := range cycle {
+		fmt.Fprintf(&b, " <-(%s:%d)- %s", e.r.file, e.r.line, e.v.name)
+	}
+	return errors.New(b.String())
+}
+
+// Deal with ambiguous rules.
+func (g *Graph) ambiguous(n *node, opts *buildOpts) {
+	var bad strings.Builder
+	var le *edge
+	for i := range n.prereqs {
+		e := n.prereqs[i]
+
+		if e.v != nil {
+			g.ambiguous(e.v, opts)
+		}
+		if e.r.recipe == "" {
+			continue
+		}
+		if le == nil || le.r == nil {
+			le = e
+		} else {
+			if !le.r.equivRecipe(e.r) && !le.r.ismeta && e.r.ismeta {
+				// Concrete rule takes priority over meta-rule.
+				// Print the discarded meta-rule recipe as a diagnostic before pruning.
+				opts.printRecipe(opts.Stdout, n.name, e.r.recipe, false)
+				e.togo = true
+				continue
+			}
+			if !le.r.equivRecipe(e.r) {
+				if bad.Len() == 0 {
+					fmt.Fprintf(&bad, "ambiguous recipes for %s", n.name)
+					g.trace(&bad, n.name, le)
+				}
+				g.trace(&bad, n.name, e)
+			}
+		}
+	}
+	if bad.Len() > 0 {
+		mkError(bad.String())
+	}
+	g.pruneEdges(n)
+}
+
+// Describe on a line of its own a trace of rules from target back through the
+// dependency chain.
+func (g *Graph) trace(w io.Writer, name string, e *edge) {
+	fmt.Fprintf(w, "\n\t%s", name)
+outer:
+	for {
+		prereqname := ""
+		if e.v != nil {
+			prereqname = e.v.name
+		}
+		fmt.Fprintf(w, " <-(%s:%d)- %s", e.r.file, e.r.line, prereqname)
+		if e.v != nil {
+			for i := range e.v.prereqs {
+				if e.v.prereqs[i].r.recipe != "" {
+					e = e.v.prereqs[i]
+					continue outer
+				}
+			}
+		}
+		break
+	}
+}
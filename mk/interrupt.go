@@ -0,0 +1,239 @@
+// Interrupts. When a build is interrupted, mk forwards the signal to the
+// process groups of the subprocesses it is running, gives them a grace period
+// to exit, and deletes the targets they were making. The mk command exits with
+// status 128 plus the signal number, as a shell reports a command killed by a
+// signal.
+//
+// With -failfast, the first failing recipe similarly aborts the others.
+//
+// A recipe that outlives its timeout, set by -timeout or the T attribute, is
+// killed, whether or not -failfast is given.
+
+package mk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// How long interrupted subprocesses have to exit before they are killed.
+const interruptGrace = 5 * time.Second
+
+// Returned when a recipe isn't started because the build is being aborted.
+var errAborted = errors.New("aborted")
+
+// Returned when a subprocess isn't started because the build was interrupted.
+var errInterrupted = errors.New("interrupted")
+
+// A recipe run by a subprocess.
+type runningProc struct {
+	name    string    // target the recipe makes
+	file    string    // file to delete if the recipe is stopped; "" if none
+	path    string    // where file is
+	mtime   time.Time // modification time of file when the recipe started
+	aborted bool      // stopped because another recipe failed
+
+	timeout  time.Duration // how long the recipe may run; 0 for no limit
+	timer    *time.Timer
+	timedOut bool // killed for running longer than timeout
+
+	stdout, stderr io.Writer // where the recipe's output goes
+	exitCode       int       // exit status, or -1 if killed or never started
+}
+
+// The subprocesses a build is running.
+type procTable struct {
+	sync.Mutex
+	procs       map[*exec.Cmd]*runningProc // nil for subprocesses other than recipes
+	exited      chan struct{}              // receives when a subprocess exits
+	interrupted []*runningProc             // recipes running when the build was interrupted
+	stopped     bool                       // the build was interrupted
+	aborting    bool
+	halted      chan struct{} // closed once aborting or stopped
+
+	// The build's standard output and error, for subprocesses other than
+	// recipes and for messages about them.
+	stdout, stderr io.Writer
+}
+
+// Create a table of subprocesses with the build's standard output and error.
+func newProcTable(stdout, stderr io.Writer) *procTable {
+	return &procTable{
+		procs:  make(map[*exec.Cmd]*runningProc),
+		exited: make(chan struct{}, 1),
+		halted: make(chan struct{}),
+		stdout: stdout,
+		stderr: stderr,
+	}
+}
+
+// Start a subprocess in a process group of its own and remember it, so that it
+// can be stopped if the build is interrupted. Once interrupted, no more
+// subprocesses start. Once aborting, no more recipes start.
+func (t *procTable) start(cmd *exec.Cmd, rp *runningProc) error {
+	setProcessGroup(cmd)
+	if rp != nil && rp.file != "" {
+		if info, err := os.Stat(rp.path); err == nil {
+			rp.mtime = info.ModTime()
+		}
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if t.stopped {
+		return errInterrupted
+	}
+	if t.aborting && rp != nil {
+		rp.aborted = true
+		fmt.Fprintf(t.stderr, "mk: aborting %s\n", rp.name)
+		return errAborted
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	t.procs[cmd] = rp
+	if rp != nil && rp.timeout > 0 {
+		rp.timer = time.AfterFunc(rp.timeout, func() { t.expire(cmd) })
+	}
+	return nil
+}
+
+// Kill a recipe that has run too long.
+func (t *procTable) expire(cmd *exec.Cmd) {
+	t.Lock()
+	if rp, ok := t.procs[cmd]; ok {
+		rp.timedOut = true
+		signalProcessGroup(cmd, os.Kill)
+	}
+	t.Unlock()
+}
+
+// Forget a subprocess that has exited.
+func (t *procTable) finish(cmd *exec.Cmd) {
+	t.Lock()
+	if rp := t.procs[cmd]; rp != nil && rp.timer != nil {
+		rp.timer.Stop()
+	}
+	delete(t.procs, cmd)
+	t.Unlock()
+
+	select {
+	case t.exited <- struct{}{}:
+	default:
+	}
+}
+
+// Kill every running recipe, and start no more, because one has failed.
+func (t *procTable) abort() {
+	t.Lock()
+	defer t.Unlock()
+	if t.aborting || t.stopped {
+		return
+	}
+	t.aborting = true
+	close(t.halted)
+	for cmd, rp := range t.procs {
+		if rp != nil {
+			rp.aborted = true
+			fmt.Fprintf(t.stderr, "mk: aborting %s\n", rp.name)
+			signalProcessGroup(cmd, os.Kill)
+		}
+	}
+}
+
+// Report whether running recipes are being aborted, or the build was
+// interrupted.
+func (t *procTable) aborted() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.aborting || t.stopped
+}
+
+// Wait for d to pass, unless running recipes are aborted or the build is
+// interrupted first. Report whether it passed.
+func (t *procTable) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-t.halted:
+	}
+	return !t.aborted()
+}
+
+// Report whether the build was interrupted.
+func (t *procTable) isInterrupted() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.stopped
+}
+
+// Delete the file a stopped recipe was making, if the recipe changed it.
+func (rp *runningProc) removeChanged(stderr io.Writer) {
+	if rp.file == "" {
+		return
+	}
+	if info, err := os.Stat(rp.path); err == nil && !info.ModTime().Equal(rp.mtime) {
+		fmt.Fprintf(stderr, "mk: deleting '%s'\n", rp.file)
+		os.Remove(rp.path)
+	}
+}
+
+// Interrupt the build: forward sig to every subprocess and wait for them to
+// exit, killing them if they outlast the grace period or another signal
+// arrives on more. No more subprocesses start.
+func (t *procTable) interrupt(sig os.Signal, more <-chan os.Signal) {
+	t.Lock()
+	if !t.stopped && !t.aborting {
+		close(t.halted)
+	}
+	t.stopped = true
+	for cmd, rp := range t.procs {
+		if rp != nil {
+			t.interrupted = append(t.interrupted, rp)
+		}
+		signalProcessGroup(cmd, sig)
+	}
+	t.Unlock()
+
+	grace := time.After(interruptGrace)
+	for {
+		t.Lock()
+		n := len(t.procs)
+		t.Unlock()
+		if n == 0 {
+			break
+		}
+		select {
+		case <-t.exited:
+		case <-grace:
+			t.killAll()
+		case <-more:
+			t.killAll()
+		}
+	}
+}
+
+// Delete the targets the recipes running when the build was interrupted
+// changed.
+func (t *procTable) removeInterrupted() {
+	t.Lock()
+	defer t.Unlock()
+	for _, rp := range t.interrupted {
+		rp.removeChanged(t.stderr)
+	}
+}
+
+// Kill every running subprocess's process group.
+func (t *procTable) killAll() {
+	t.Lock()
+	for cmd := range t.procs {
+		signalProcessGroup(cmd, os.Kill)
+	}
+	t.Unlock()
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package mk
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Process groups are a Unix notion; elsewhere subprocesses are left as they
+// are.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// Send a signal to a subprocess. Only the subprocess itself receives it, and
+// only os.Kill is certain to be delivered.
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) {
+	if cmd.Process.Signal(sig) != nil {
+		cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package mk
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Run a subprocess in a new process group, so that it and its children can be
+// signalled together.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Send a signal to a subprocess's process group.
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) {
+	if s, ok := sig.(syscall.Signal); ok {
+		syscall.Kill(-cmd.Process.Pid, s)
+	}
+}
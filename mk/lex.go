@@ -1,4 +1,4 @@
-package main
+package mk
 
 import (
 	"fmt"
@@ -31,6 +31,7 @@ const (
 	tokenAssign
 	tokenRecipe
 	tokenAssignU // =U= unexport assignment
+	tokenComment // only from a lexer keeping comments
 )
 
 func (typ tokenType) String() string {
@@ -53,6 +54,8 @@ func (typ tokenType) String() string {
 		return "[Recipe]"
 	case tokenAssignU:
 		return "[AssignU]"
+	case tokenComment:
+		return "[Comment]"
 	}
 	return "[MysteryToken]"
 }
@@ -60,8 +63,9 @@ func (typ tokenType) String() string {
 type token struct {
 	typ  tokenType // token type
 	val  string    // token string
-	line int       // line where it was found
+	line int       // line on which the token began
 	col  int       // column on which the token began
+	off  int       // byte offset at which the token began
 }
 
 func (t *token) String() string {
@@ -79,6 +83,7 @@ type lexer struct {
 	input     string     // input string to be lexed
 	output    chan token // channel on which tokens are sent
 	start     int        // token beginning
+	startline int        // line on which the token begins
 	startcol  int        // column on which the token begins
 	pos       int        // position within input
 	line      int        // line within input
@@ -86,6 +91,7 @@ type lexer struct {
 	errmsg    string     // set to an appropriate error message when necessary
 	indented  bool       // true if the only whitespace so far on this line
 	barewords bool       // lex only a sequence of words
+	comments  bool       // emit comments rather than skipping them
 }
 
 // A lexerStateFun is simultaneously the the state of the lexer and the next
@@ -147,13 +153,15 @@ func (l *lexer) next() rune {
 func (l *lexer) skip() {
 	l.next()
 	l.start = l.pos
+	l.startline = l.line
 	l.startcol = l.col
 }
 
 func (l *lexer) emit(typ tokenType) {
-	l.output <- token{typ, l.input[l.start:l.pos], l.line, l.startcol}
+	l.output <- token{typ, l.input[l.start:l.pos], l.startline, l.startcol, l.start}
 	l.start = l.pos
-	l.startcol = 0
+	l.startline = l.line
+	l.startcol = l.col
 }
 
 // Consume the next run if it is in the given string.
@@ -214,18 +222,24 @@ func (l *lexer) skipUntil(invalid string) {
 
 // Start a new lexer to lex the given input.
 func lex(input string) (*lexer, chan token) {
+	return lexFile(input, false)
+}
+
+// Start a new lexer to lex the given input, emitting its comments as tokens
+// if comments is set.
+func lexFile(input string, comments bool) (*lexer, chan token) {
 	// Files without a trailing newline are considered to have one.
 	if len(input) > 0 && input[len(input)-1] != '\n' {
 		input = input + "\n"
 	}
 
-	l := &lexer{input: input, output: make(chan token), line: 1, col: 0, indented: true}
+	l := &lexer{input: input, output: make(chan token), line: 1, startline: 1, col: 0, indented: true, comments: comments}
 	go l.run()
 	return l, l.output
 }
 
 func lexWords(input string) (*lexer, chan token) {
-	l := &lexer{input: input, output: make(chan token), line: 1, col: 0, indented: true, barewords: true}
+	l := &lexer{input: input, output: make(chan token), line: 1, startline: 1, col: 0, indented: true, barewords: true}
 	go l.run()
 	return l, l.output
 }
@@ -306,17 +320,32 @@ func lexAssign(l *lexer) lexerStateFun {
 }
 
 func lexComment(l *lexer) lexerStateFun {
-	l.skip() // '#'
+	if l.comments {
+		l.next() // '#'
+	} else {
+		l.skip() // '#'
+	}
 	for {
-		l.skipUntil("\n")
+		if l.comments {
+			l.acceptUntil("\n")
+		} else {
+			l.skipUntil("\n")
+		}
 		// Check if the character before the newline is a backslash.
 		// If so, the comment continues on the next line (Plan 9 convention).
 		if l.pos > 0 && l.input[l.pos-1] == '\\' {
-			l.skip() // skip the newline
+			if l.comments {
+				l.next() // the newline
+			} else {
+				l.skip() // skip the newline
+			}
 			continue
 		}
 		break
 	}
+	if l.comments {
+		l.emit(tokenComment)
+	}
 	return lexTopLevel
 }
 
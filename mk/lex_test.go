@@ -1,4 +1,4 @@
-package main
+package mk
 
 import "testing"
 
@@ -17,6 +17,7 @@ func TestTokenTypeString(t *testing.T) {
 		{"assign", tokenAssign, "[Assign]"},
 		{"recipe", tokenRecipe, "[Recipe]"},
 		{"assign_u", tokenAssignU, "[AssignU]"},
+		{"comment", tokenComment, "[Comment]"},
 		{"unknown", tokenType(999), "[MysteryToken]"},
 	}
 	for _, tt := range tests {
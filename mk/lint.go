@@ -0,0 +1,226 @@
+// Checking mkfiles for likely mistakes: variables assigned but never used, or
+// used but never assigned, meta-rules that can never match, recipes replaced
+// by later rules, targets that look virtual but aren't marked V, and
+// prerequisites that can't be made.
+
+package mk
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Variables mk reads itself, which a mkfile may assign for mk's sake alone.
+var mkVars = map[string]bool{"shell": true, "MKSHELL": true, "MKPOOLS": true}
+
+// Targets that are usually virtual, naming what a rule does rather than a file
+// it makes.
+var virtualTargets = map[string]bool{
+	"all": true, "check": true, "clean": true, "clobber": true, "distclean": true,
+	"install": true, "nuke": true, "test": true, "uninstall": true,
+}
+
+// Check a parsed mkfile, and those it includes, for likely mistakes. Return a
+// warning for each, in the order of the files and the lines they're on.
+func Lint(rs *RuleSet) Diagnostics {
+	ds := rs.Warnings()
+	ds = append(ds, lintVars(rs)...)
+	ds = append(ds, lintRules(rs)...)
+
+	order := make(map[string]int)
+	for i, f := range rs.files {
+		if _, ok := order[f.Name]; !ok {
+			order[f.Name] = i
+		}
+	}
+	slices.SortStableFunc(ds, func(a, b Diagnostic) int {
+		return cmp.Or(cmp.Compare(order[a.File], order[b.File]),
+			cmp.Compare(a.Line, b.Line), cmp.Compare(a.Col, b.Col))
+	})
+	return ds
+}
+
+// Return a warning about a node of a file.
+func warningAt(f *File, n Node, format string, args ...any) Diagnostic {
+	return Diagnostic{
+		File:     f.Name,
+		Line:     n.Pos().Line,
+		Col:      n.Pos().Col,
+		Severity: SeverityWarning,
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+// Return a warning about a rule.
+func warningAtRule(r *rule, format string, args ...any) Diagnostic {
+	return Diagnostic{
+		File:     r.file,
+		Line:     r.line,
+		Severity: SeverityWarning,
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+// Report whether mk sets a variable for each recipe.
+func isAutomaticVar(name string) bool {
+	switch name {
+	case "alltarget", "mkfiledir", "newmember", "newprereq", "nproc", "pid", "prereq", "stem", "target":
+		return true
+	}
+	for _, prefix := range []string{"stem", "prereq"} {
+		if n, ok := strings.CutPrefix(name, prefix); ok && n != "" && strings.Trim(n, "0123456789") == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the names of the variables a word refers to. Nothing in single
+// quotes is a reference.
+func wordVarRefs(word string) []string {
+	var unquoted strings.Builder
+	for i, part := range strings.Split(word, "'") {
+		if i%2 == 0 {
+			unquoted.WriteString(part)
+		}
+	}
+	return recipeVarRefs(unquoted.String())
+}
+
+// Warn of variables assigned but never referred to, and of references to
+// variables never assigned. References in recipes count as uses, but a recipe
+// may refer to the shell's own variables, so aren't checked.
+func lintVars(rs *RuleSet) Diagnostics {
+	var ds Diagnostics
+	used := make(map[string]bool)
+	refer := func(f *File, words []Word) {
+		for _, w := range words {
+			for _, name := range wordVarRefs(w.Text) {
+				used[name] = true
+				_, assigned := rs.vars[name]
+				_, inEnv := rs.env[name]
+				if !assigned && !inEnv && !isAutomaticVar(name) {
+					ds = append(ds, warningAt(f, w, "$%s is not assigned", name))
+				}
+			}
+		}
+	}
+
+	type assignment struct {
+		f *File
+		a *Assignment
+	}
+	var assigned []assignment
+	seen := make(map[string]bool)
+	for _, f := range rs.files {
+		for _, s := range f.Stmts {
+			switch s := s.(type) {
+			case *Assignment:
+				refer(f, s.Value)
+				if !seen[s.Name.Text] {
+					seen[s.Name.Text] = true
+					assigned = append(assigned, assignment{f, s})
+				}
+			case *Include:
+				refer(f, s.Args)
+			case *Rule:
+				refer(f, s.Targets)
+				refer(f, s.Attributes)
+				refer(f, s.Prereqs)
+				if s.Recipe != nil {
+					for _, name := range recipeVarRefs(s.Recipe.Text) {
+						used[name] = true
+					}
+				}
+			}
+		}
+	}
+
+	for _, as := range assigned {
+		name := as.a.Name.Text
+		if used[name] || mkVars[name] || rs.env[name] != nil {
+			continue
+		}
+		ds = append(ds, warningAt(as.f, as.a, "%s is assigned but never used", name))
+	}
+	return ds
+}
+
+// Warn of meta-rules that can never match, targets that look virtual but
+// aren't marked V, and prerequisites with no rule to make them that don't
+// exist.
+func lintRules(rs *RuleSet) Diagnostics {
+	var ds Diagnostics
+	reported := make(map[string]bool)
+	wd := &workDir{dir: rs.shell.dir}
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if r.ismeta {
+			if msg := neverMatches(r); msg != "" {
+				ds = append(ds, warningAtRule(r, "%s", msg))
+			}
+			continue
+		}
+
+		for _, t := range r.targets {
+			if virtualTargets[t.spat] && !reported[t.spat] && !rs.isVirtual(t.spat) {
+				reported[t.spat] = true
+				ds = append(ds, warningAtRule(r, "%s is not marked V, so a file named %s would keep it from being made", t.spat, t.spat))
+			}
+		}
+		for _, p := range r.prereqs {
+			// A reference to a variable never assigned is left in the name,
+			// and is reported as such.
+			if reported[p] || strings.Contains(p, "$") || rs.canMake(p) {
+				continue
+			}
+			n := &node{name: p}
+			n.updateTimestamp(wd, false)
+			if !n.exists {
+				reported[p] = true
+				ds = append(ds, warningAtRule(r, "%s has no rule to make it and doesn't exist", p))
+			}
+		}
+	}
+	return ds
+}
+
+// Report whether any rule making a target is marked V.
+func (rs *RuleSet) isVirtual(target string) bool {
+	for _, k := range rs.targetrules[target] {
+		if rs.rules[k].attributes.virtual {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether a rule, or meta-rule, has a target matching a name.
+func (rs *RuleSet) canMake(name string) bool {
+	if len(rs.targetrules[name]) > 0 {
+		return true
+	}
+	for _, m := range rs.meta.candidates(name) {
+		if rs.rules[m.rule].targets[m.target].match(name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Return why a meta-rule can never match, or "" if it can.
+func neverMatches(r *rule) string {
+	if r.recipe == "" && len(r.prereqs) == 0 && !r.attributes.forcedTimestamp {
+		return "meta-rule has no recipe or prerequisites, so never applies"
+	}
+	for _, t := range r.targets {
+		if t.issuffix {
+			if i := strings.IndexAny(t.suffix, "%&"); i >= 0 {
+				return fmt.Sprintf("%s can only match names with a literal %c in them: just the first %% or & of a target matches a stem", t.spat, t.suffix[i])
+			}
+		}
+	}
+	return ""
+}
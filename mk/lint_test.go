@@ -0,0 +1,75 @@
+package mk
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+// Return the messages of the warnings Lint finds in a mkfile.
+func lintMessages(t *testing.T, input string, env map[string][]string) []string {
+	t.Helper()
+	rs, err := Parse(input, "mkfile", "/mkfile", ParseOptions{Env: env})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []string
+	for _, d := range Lint(rs) {
+		if d.Severity != SeverityWarning {
+			t.Errorf("%s isn't a warning", d)
+		}
+		msgs = append(msgs, d.Message)
+	}
+	return msgs
+}
+
+func TestLintVars(t *testing.T) {
+	t.Chdir(t.TempDir())
+	// Only the environment the mkfile is parsed in counts, not mk's own.
+	t.Setenv("OSONLY", "1")
+	for _, name := range []string{"0", "1", "2"} {
+		if err := os.WriteFile(name, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := lintMessages(t, `A=1
+B=2
+C=$B '$quoted' ${D:%=%.o}
+MKSHELL=sh
+FROMENV=1
+x:V: $C $stem $ENVONLY $OSONLY
+	echo $A $target $shellvar
+`, map[string][]string{"FROMENV": {"0"}, "ENVONLY": {"0"}})
+	want := []string{
+		"$D is not assigned",
+		"$OSONLY is not assigned",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("warnings are %q, want %q", got, want)
+	}
+}
+
+func TestLintRules(t *testing.T) {
+	t.Chdir(t.TempDir())
+	got := lintMessages(t, `all: a.o b
+test:V: all
+a.o:
+	echo a
+b:
+	echo b
+b:
+	echo b again
+%.o: %.c
+	cc -c $stem.c
+install: c.o
+	echo
+`, nil)
+	want := []string{
+		"all is not marked V, so a file named all would keep it from being made",
+		"recipe is replaced by the rule at mkfile:7",
+		"install is not marked V, so a file named install would keep it from being made",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("warnings are %q, want %q", got, want)
+	}
+}
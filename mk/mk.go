@@ -0,0 +1,439 @@
+// Package mk reads mkfiles and builds their targets, as the mk command does.
+//
+// A mkfile is parsed once into a RuleSet, which can then be built any number
+// of times:
+//
+//	rs, err := mk.Parse(input, "mkfile", "/src/proj/mkfile", mk.ParseOptions{})
+//	if err != nil {
+//		return err
+//	}
+//	res, err := mk.Build(ctx, rs, mk.Options{Targets: []string{"all"}})
+//
+// Builds run recipes, and find the files their targets name, in Options.Dir,
+// or the process's working directory if it is empty. Commands run while
+// parsing, and included files, are likewise relative to ParseOptions.Dir.
+
+package mk
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"runtime"
+	"slices"
+	"time"
+)
+
+// Options configure a build. The zero value builds the mkfile's default
+// targets with as many jobs as there are CPUs.
+type Options struct {
+	// The targets to make. If empty, those of the mkfile's first rule that
+	// isn't a meta-rule.
+	Targets []string
+
+	Jobs               int           // recipes run at once (-p); 0 for runtime.NumCPU()
+	DryRun             bool          // print recipes without running them (-n)
+	Touch              bool          // touch targets instead of running recipes (-t)
+	KeepGoing          bool          // make what can be made after an error (-k)
+	FailFast           bool          // abort running recipes when one fails (-failfast)
+	Timeout            time.Duration // how long a recipe may run (-timeout); 0 for no limit
+	RebuildAll         bool          // remake every target (-a)
+	Rebuild            []string      // targets to remake though up to date (-r)
+	PretendModified    string        // target to treat as just modified (-w)
+	MaxRuleCount       int           // times a rule may apply in a chain (-l); 0 for 1
+	ForceIntermediates bool          // make missing intermediate targets (-i)
+	Explain            bool          // explain why targets are out of date (-e)
+	Hash               bool          // compare content digests, not timestamps (-hash)
+	Quiet              bool          // don't print recipes (-q)
+	Output             string        // stream, buffered or oldest (-output); "" for stream
+	Color              bool          // print recipes and errors in color
+
+	// The directory recipes run in, and that the names of targets and
+	// prerequisites are relative to; "" for the process's working directory.
+	Dir string
+
+	// Where recipes and messages are printed; nil for os.Stdout and
+	// os.Stderr.
+	Stdout, Stderr io.Writer
+
+	// If not nil, where the event stream (-events) and the timeline (-trace)
+	// are written.
+	Events, Trace io.Writer
+
+	// The build database recording recipes, digests and durations between
+	// builds; the mk command keeps it in the mkfile's directory. If empty,
+	// nothing is remembered from one build to the next.
+	Database string
+
+	// Signals that interrupt the build. On the first, running recipes are sent
+	// the signal and given a grace period to exit; on the next, or when the
+	// period is up, they are killed.
+	Signals <-chan os.Signal
+}
+
+// The name of the build database the mk command keeps in the mkfile's
+// directory.
+const DatabaseName = buildDBName
+
+// ParseOptions configure the parsing of a mkfile.
+type ParseOptions struct {
+	Env           map[string][]string // variables set before the mkfile is read, usually the environment
+	Shell         string              // the shell when the mkfile names none; "" for "sh -e"
+	KeepShellArgs bool                // don't drop the shell's arguments when a recipe has none (-F)
+	Dir           string              // where backticks and pipe includes run, and included files are found; "" for the working directory
+}
+
+// Parse a mkfile. The name is used in messages, and path is the mkfile's
+// location, from which $mkfiledir is set. If the mkfile has errors, Parse
+// returns all of those it finds as Diagnostics, with the RuleSet parsed from
+// the rest of the mkfile.
+func Parse(input, name, path string, opts ParseOptions) (rs *RuleSet, err error) {
+	defer recoverFatal(&err)
+	env := maps.Clone(opts.Env)
+	if env == nil {
+		env = make(map[string][]string)
+	}
+	shell := shellConfig{command: cmp.Or(opts.Shell, defaultShell), keepArgs: opts.KeepShellArgs, dir: opts.Dir}
+	rs = parseWith(input, name, path, env, shell)
+	rs.env = opts.Env
+	if rs.diags.hasErrors() {
+		return rs, rs.diags.withSeverity(SeverityError)
+	}
+	return rs, nil
+}
+
+// Return the warnings found parsing the mkfile: problems that don't keep it
+// from being used, such as a recipe replaced by a later rule's. Lint returns
+// them too.
+func (rs *RuleSet) Warnings() Diagnostics {
+	return rs.diags.withSeverity(SeverityWarning)
+}
+
+// Return the syntax tree of the mkfile, as written. Included files are not in
+// it, only the includes.
+func (rs *RuleSet) Syntax() *File {
+	return rs.files[0]
+}
+
+// Return the value of a variable, as the mkfile left it.
+func (rs *RuleSet) Var(name string) []string {
+	return rs.vars[name]
+}
+
+// Set a variable, overriding the mkfile, as name=value on the command line
+// does. The value is expanded as an assignment's is.
+func (rs *RuleSet) SetVar(name, value string) (err error) {
+	defer recoverFatal(&err)
+	if !isValidVarName(name) {
+		return fmt.Errorf("invalid variable name %q", name)
+	}
+	rs.vars[name] = expand(value, rs.vars, rs.backticks())
+	return nil
+}
+
+// Report whether name can be the name of a variable, as in name=value.
+func IsVarName(name string) bool {
+	return isValidVarName(name)
+}
+
+// Return the targets of the mkfile's first rule that isn't a meta-rule, which
+// are made when no others are given.
+func (rs *RuleSet) DefaultTargets() []string {
+	for i := range rs.rules {
+		if !rs.rules[i].ismeta {
+			var targets []string
+			for j := range rs.rules[i].targets {
+				targets = append(targets, rs.rules[i].targets[j].spat)
+			}
+			return targets
+		}
+	}
+	return nil
+}
+
+// Return the targets to build, and the configuration of their build.
+func newBuildOpts(rs *RuleSet, opts Options) (*buildOpts, error) {
+	if len(opts.Targets) == 0 {
+		opts.Targets = rs.DefaultTargets()
+	}
+	if opts.Jobs <= 0 {
+		opts.Jobs = runtime.NumCPU()
+	}
+	opts.MaxRuleCount = max(1, opts.MaxRuleCount)
+	opts.Output = cmp.Or(opts.Output, outputStream)
+	if opts.Stdout == nil {
+		opts.Stdout = os.Stdout
+	}
+	if opts.Stderr == nil {
+		opts.Stderr = os.Stderr
+	}
+	if err := validOutputMode(opts.Output); err != nil {
+		return nil, err
+	}
+
+	pools, err := parsePools(rs.vars["MKPOOLS"])
+	if err != nil {
+		return nil, err
+	}
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if name := r.attributes.pool; name != "" && pools[name] == nil {
+			return nil, fmt.Errorf("rule for %s uses undeclared pool %q", r.targets[0].spat, name)
+		}
+	}
+
+	o := &buildOpts{
+		Options:        opts,
+		vars:           rs.vars,
+		unexportedVars: rs.unexportedVars,
+		shell:          rs.shell,
+		rebuildTargets: make(map[string]bool),
+		sched:          &scheduler{allowed: opts.Jobs, pools: pools},
+		outputs:        &outputs{mode: opts.Output},
+		procs:          newProcTable(opts.Stdout, opts.Stderr),
+		wd:             &workDir{dir: opts.Dir},
+	}
+	// Backticks expanded while the graph is built run where recipes do.
+	o.shell.dir = opts.Dir
+	for _, t := range opts.Rebuild {
+		o.rebuildTargets[t] = true
+	}
+	return o, nil
+}
+
+// BuildGraph returns the dependency graph a build with the given options
+// would make, without making anything.
+func BuildGraph(rs *RuleSet, opts Options) (g *Graph, err error) {
+	defer recoverFatal(&err)
+	o, err := newBuildOpts(rs, opts)
+	if err != nil {
+		return nil, err
+	}
+	return buildgraph(rs, o.Targets, o), nil
+}
+
+// Write the graph in graphviz dot format.
+func (g *Graph) WriteDot(w io.Writer) {
+	g.visualize(w)
+}
+
+// Return the names of the graph's targets, sorted.
+func (g *Graph) Targets() []string {
+	var names []string
+	for name := range g.nodes {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Return the prerequisites of a target in the graph, in the order its rule
+// names them.
+func (g *Graph) Prereqs(target string) []string {
+	n := g.nodes[target]
+	if n == nil {
+		return nil
+	}
+	var names []string
+	for _, e := range n.prereqs {
+		if e.v != nil {
+			names = append(names, e.v.name)
+		}
+	}
+	return names
+}
+
+// An Interrupted error is returned by Build when a signal interrupted the
+// build.
+type Interrupted struct {
+	Signal os.Signal
+}
+
+func (e *Interrupted) Error() string {
+	return fmt.Sprintf("interrupted by signal %s", e.Signal)
+}
+
+// Statuses of targets in a build's result.
+const (
+	StatusBuilt    = "built"      // its recipe ran
+	StatusUpToDate = "up to date" // it didn't need making
+	StatusFailed   = "failed"     // its recipe failed
+	StatusSkipped  = "skipped"    // not made because a prerequisite or another recipe failed
+)
+
+// The outcome of a build.
+type Result struct {
+	Failed  bool           // some target wasn't made
+	Targets []TargetResult // the targets the build looked at, by name
+
+	g    *Graph
+	jobs int
+}
+
+// The outcome of a build for one target.
+type TargetResult struct {
+	Name   string
+	Status string        // one of the Status constants
+	Rule   string        // where the rule making it is, as file:line; "" for none
+	Recipe *RecipeResult // nil if its recipe didn't run
+}
+
+// The outcome of a recipe.
+type RecipeResult struct {
+	Status   string        // ok, failed, timeout or aborted
+	ExitCode int           // of the last attempt; -1 if it was killed
+	Duration time.Duration // of every attempt
+	Slots    int           // job slots held
+}
+
+// Build the targets of a mkfile. The error is nil when the build ran to its
+// end, whether or not all of its recipes succeeded: Result.Failed says that.
+// If the build was stopped, by an error, an interrupt, or the context being
+// canceled, the result so far is returned with the error. Canceling the
+// context kills running recipes at once.
+func Build(ctx context.Context, rs *RuleSet, opts Options) (res *Result, err error) {
+	defer recoverFatal(&err)
+	o, err := newBuildOpts(rs, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(o.Targets) == 0 {
+		return &Result{jobs: o.Jobs}, nil
+	}
+	o.db = loadBuildDB(o.Database)
+	if o.Events != nil {
+		o.events = newEventLog(o.Events)
+	}
+	if o.Trace != nil {
+		o.trace = newTraceLog(o.Trace)
+	}
+
+	g := buildgraph(rs, o.Targets, o)
+
+	// Recipes on the longest chains, as they last took, go first. One job at
+	// a time, prerequisites are made in order.
+	if o.Jobs > 1 {
+		g.prioritize(o.db.duration)
+	}
+
+	if n, ok := g.nodes[o.PretendModified]; ok && o.PretendModified != "" {
+		n.t = time.Now()
+		n.flags |= nodeFlagProbable | nodeFlagForcedTime
+	}
+
+	o.events.emit(event{Type: eventGraph, Nodes: len(g.nodes) - 1}) // less the root
+
+	// Interrupts stop the executor, and the recipes it is running.
+	x := newExecutor(g, o)
+	var interrupt error
+	done, watched := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(watched)
+		select {
+		case sig := <-o.Signals:
+			interrupt = &Interrupted{sig}
+			x.stop(interrupt)
+			o.procs.interrupt(sig, o.Signals)
+		case <-ctx.Done():
+			interrupt = context.Cause(ctx)
+			x.stop(interrupt)
+			o.procs.interrupt(os.Kill, nil)
+		case <-done:
+		}
+	}()
+	err = x.run(g.root, true)
+	close(done)
+	<-watched
+	if interrupt != nil {
+		o.procs.removeInterrupted()
+		if terr := o.trace.finish(); terr != nil {
+			o.printError(fmt.Sprintf("writing trace: %s", terr))
+		}
+		o.events.finish("interrupted")
+		res = newResult(g, o.Jobs)
+		res.Failed = true
+		return res, interrupt
+	}
+
+	if !o.DryRun {
+		if serr := o.db.save(); serr != nil {
+			o.printError(fmt.Sprintf("saving build database: %s", serr))
+		}
+	}
+	if terr := o.trace.finish(); terr != nil {
+		o.printError(fmt.Sprintf("writing trace: %s", terr))
+	}
+	if o.events != nil {
+		cp := findCriticalPath(g)
+		o.events.emit(cp.event(o.Jobs))
+	}
+	res = newResult(g, o.Jobs)
+	res.Failed = res.Failed || err != nil
+	if res.Failed {
+		o.events.finish("failed")
+	} else {
+		o.events.finish("ok")
+	}
+	return res, err
+}
+
+// Collect the outcome of building g.
+func newResult(g *Graph, jobs int) *Result {
+	res := &Result{Failed: g.root.status == nodeStatusFailed, g: g, jobs: jobs}
+	for _, name := range g.Targets() {
+		n := g.nodes[name]
+		tr := TargetResult{Name: name}
+		switch {
+		case n.status == nodeStatusDone:
+			tr.Status = StatusBuilt
+		case n.status == nodeStatusNop:
+			tr.Status = StatusUpToDate
+		case n.status == nodeStatusFailed && n.run != nil:
+			tr.Status = StatusFailed
+		case n.status == nodeStatusFailed:
+			tr.Status = StatusSkipped
+		default:
+			continue // never looked at
+		}
+		for _, e := range n.prereqs {
+			if e.r != nil {
+				tr.Rule = fmt.Sprintf("%s:%d", e.r.file, e.r.line)
+				break
+			}
+		}
+		if n.run != nil {
+			tr.Recipe = &RecipeResult{
+				Status:   n.run.status,
+				ExitCode: n.run.exitCode,
+				Duration: n.run.duration,
+				Slots:    n.run.slots,
+			}
+		}
+		res.Targets = append(res.Targets, tr)
+	}
+	return res
+}
+
+// Write a summary of the build: the targets that failed and why, those skipped
+// because of them, and the slowest recipes, as -summary prints.
+func (res *Result) WriteSummary(w io.Writer) {
+	if res.g == nil {
+		return
+	}
+	printSummary(w, res.g)
+}
+
+// Write the build's critical path, the chain of recipes that took longest, as
+// -critical prints.
+func (res *Result) WriteCriticalPath(w io.Writer) {
+	if res.g == nil {
+		return
+	}
+	cp := findCriticalPath(res.g)
+	cp.print(w, res.jobs)
+}
@@ -0,0 +1,247 @@
+package mk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseError(t *testing.T) {
+	rs, err := Parse("a: b\n:\nc:Z:\n", "mkfile", "/mkfile", ParseOptions{})
+	var diags Diagnostics
+	if !errors.As(err, &diags) || len(diags) != 2 {
+		t.Fatalf("Parse of a bad mkfile returned %v, want two diagnostics", err)
+	}
+	if got, want := diags[0].Error(), "mkfile:2:1: syntax error"; !strings.HasPrefix(got, want) {
+		t.Errorf("first diagnostic is %q, want it to begin %q", got, want)
+	}
+	if rs == nil || len(rs.DefaultTargets()) != 1 {
+		t.Errorf("the rule for a wasn't parsed")
+	}
+}
+
+// Warnings aren't errors: Parse returns only the errors, and Warnings the
+// rest.
+func TestParseWarnings(t *testing.T) {
+	input := "a:V:\n\techo 1\na:V:\n\techo 2\n"
+	rs, err := Parse(input, "mkfile", "/mkfile", ParseOptions{})
+	if err != nil {
+		t.Fatalf("Parse of a mkfile with a replaced recipe returned %v", err)
+	}
+	want := "mkfile:1: warning: recipe is replaced by the rule at mkfile:3"
+	if ws := rs.Warnings(); len(ws) != 1 || ws[0].Error() != want {
+		t.Errorf("warnings are %v, want %q", ws, want)
+	}
+
+	rs, err = Parse(input+":\n", "mkfile", "/mkfile", ParseOptions{})
+	var diags Diagnostics
+	if !errors.As(err, &diags) || len(diags) != 1 || diags[0].Severity != SeverityError {
+		t.Errorf("Parse of a mkfile with an error returned %v, want the error alone", err)
+	}
+	if ws := rs.Warnings(); len(ws) != 1 {
+		t.Errorf("warnings are %v, want one", ws)
+	}
+}
+
+func TestSetVar(t *testing.T) {
+	rs, err := Parse("X=a\nall:V:\n\techo $X\n", "mkfile", "/mkfile", ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.SetVar("X", "b $X"); err != nil {
+		t.Fatal(err)
+	}
+	if got := rs.Var("X"); len(got) != 1 || got[0] != "b a" {
+		t.Errorf("X = %q, want [\"b a\"]", got)
+	}
+	if err := rs.SetVar("1X", "b"); err == nil {
+		t.Errorf("SetVar of an invalid name succeeded")
+	}
+}
+
+func TestBuild(t *testing.T) {
+	t.Chdir(t.TempDir())
+	rs, err := Parse("all:V: out\nout: in\n\tcp in out\n", "mkfile", "mkfile", ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("in", []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout bytes.Buffer
+	opts := Options{Jobs: 1, Stdout: &stdout, Database: DatabaseName}
+	res, err := Build(context.Background(), rs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Failed {
+		t.Errorf("build failed")
+	}
+	if got, want := stdout.String(), "out: cp in out\n"; got != want {
+		t.Errorf("stdout = %q, want %q", got, want)
+	}
+	out := targetResult(res, "out")
+	if out == nil || out.Status != StatusBuilt || out.Rule != "mkfile:2" ||
+		out.Recipe == nil || out.Recipe.Status != "ok" || out.Recipe.ExitCode != 0 {
+		t.Errorf("result for out = %+v, want built by mkfile:2", out)
+	}
+
+	// The RuleSet builds again, finding nothing to do.
+	res, err = Build(context.Background(), rs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := targetResult(res, "out"); out == nil || out.Status != StatusUpToDate || out.Recipe != nil {
+		t.Errorf("result for out = %+v, want up to date", out)
+	}
+}
+
+func TestBuildDir(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{"in": "x", "inc.mk": "N=`cat in`\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Includes and backticks are read and run in the parse's directory, and
+	// recipes in the build's, without changing the working directory.
+	rs, err := Parse("<inc.mk\nall:V: out\nout: in\n\techo $N > out\n", "mkfile", "mkfile", ParseOptions{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Jobs: 1, Stdout: &bytes.Buffer{}, Dir: dir}
+	res, err := Build(context.Background(), rs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := targetResult(res, "out"); out == nil || out.Status != StatusBuilt {
+		t.Errorf("result for out = %+v, want built", out)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "out")); err != nil || string(data) != "x\n" {
+		t.Errorf("out holds %q, %v, want \"x\\n\"", data, err)
+	}
+
+	// Its timestamp is found there too.
+	res, err = Build(context.Background(), rs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := targetResult(res, "out"); out == nil || out.Status != StatusUpToDate {
+		t.Errorf("result for out = %+v, want up to date", out)
+	}
+
+	// A missing prerequisite is reported in the build's directory.
+	os.Remove(filepath.Join(dir, "in"))
+	os.Remove(filepath.Join(dir, "out"))
+	_, err = Build(context.Background(), rs, opts)
+	if want := "don't know how to make in in " + dir; err == nil || err.Error() != want {
+		t.Errorf("build with in missing returned %v, want %q", err, want)
+	}
+}
+
+func TestBuildFailed(t *testing.T) {
+	t.Chdir(t.TempDir())
+	rs, err := Parse("all:V: a b\na:V:\n\texit 3\nb:V: a\n\ttrue\n", "mkfile", "mkfile", ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	res, err := Build(context.Background(), rs, Options{Jobs: 1, Stdout: &bytes.Buffer{}, Stderr: &stderr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Failed {
+		t.Errorf("build succeeded, want failure")
+	}
+	if a := targetResult(res, "a"); a == nil || a.Status != StatusFailed || a.Recipe.ExitCode != 3 {
+		t.Errorf("result for a = %+v, want failed with status 3", a)
+	}
+	if b := targetResult(res, "b"); b == nil || b.Status != StatusSkipped {
+		t.Errorf("result for b = %+v, want skipped", b)
+	}
+	var summary bytes.Buffer
+	res.WriteSummary(&summary)
+	if !strings.Contains(summary.String(), "0 built, 0 up to date, 1 failed, 2 skipped") {
+		t.Errorf("summary:\n%s", summary.String())
+	}
+}
+
+func TestBuildCanceled(t *testing.T) {
+	t.Chdir(t.TempDir())
+	rs, err := Parse("out:\n\ttouch started\n\techo partial > out\n\tsleep 10\n", "mkfile", "mkfile", ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for {
+			if _, err := os.Stat("started"); err == nil {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	start := time.Now()
+	res, err := Build(ctx, rs, Options{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Build returned %v, want %v", err, context.Canceled)
+	}
+	if res == nil || !res.Failed {
+		t.Errorf("result = %+v, want a failed build", res)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("canceled build took %s", d)
+	}
+	if _, err := os.Stat("out"); err == nil {
+		t.Errorf("canceled recipe's target wasn't deleted")
+	}
+}
+
+// Canceling the context ends a recipe's wait to be retried.
+func TestBuildCanceledRetry(t *testing.T) {
+	t.Chdir(t.TempDir())
+	rs, err := Parse("out:VA1/1m:\n\ttouch started\n\texit 1\n", "mkfile", "mkfile", ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for {
+			if _, err := os.Stat("started"); err == nil {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	start := time.Now()
+	var stdout bytes.Buffer
+	_, err = Build(ctx, rs, Options{Stdout: &stdout, Stderr: &bytes.Buffer{}})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Build returned %v, want %v", err, context.Canceled)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("canceled build took %s", d)
+	}
+	if n := strings.Count(stdout.String(), "touch started"); n != 1 {
+		t.Errorf("recipe printed %d times, want once", n)
+	}
+}
+
+// Return the result for a target, or nil if there isn't one.
+func targetResult(res *Result, name string) *TargetResult {
+	for i := range res.Targets {
+		if res.Targets[i].Name == name {
+			return &res.Targets[i]
+		}
+	}
+	return nil
+}
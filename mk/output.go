@@ -0,0 +1,116 @@
+// Recipe output. By default recipes write straight to mk's standard output
+// and error, so the output of recipes running in parallel interleaves. With
+// -output buffered, each recipe's output is held until the recipe finishes
+// and then written all at once, after its echoed recipe. With -output oldest,
+// the recipe that has been running longest streams its output live, and the
+// others' is held until they finish or become the oldest.
+
+package mk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+)
+
+// Output modes.
+const (
+	outputStream   = "stream"
+	outputBuffered = "buffered"
+	outputOldest   = "oldest"
+)
+
+// The output of a running recipe.
+type jobOutput struct {
+	o      *outputs
+	live   bool          // written through rather than held
+	chunks []outputChunk // held output, in the order it was written
+}
+
+// Output written to one of the build's streams.
+type outputChunk struct {
+	dst  io.Writer
+	data []byte
+}
+
+// The output of a build's running recipes, in the order they started.
+type outputs struct {
+	sync.Mutex
+	mode    string // how recipe output is written (-output)
+	running []*jobOutput
+}
+
+// Check that an output mode is known.
+func validOutputMode(mode string) error {
+	switch mode {
+	case outputStream, outputBuffered, outputOldest:
+		return nil
+	}
+	return fmt.Errorf("unknown output mode %q, expected %s, %s or %s", mode, outputStream, outputBuffered, outputOldest)
+}
+
+// Begin collecting the output of a recipe.
+func (o *outputs) start() *jobOutput {
+	o.Lock()
+	defer o.Unlock()
+	jo := &jobOutput{o: o}
+	switch o.mode {
+	case outputStream:
+		jo.live = true
+	case outputOldest:
+		jo.live = len(o.running) == 0
+	}
+	o.running = append(o.running, jo)
+	return jo
+}
+
+// Return a writer for the recipe's output to dst (the build's standard output
+// or error). When streaming, this is dst itself, so recipes can tell they
+// write to a terminal.
+func (jo *jobOutput) writer(dst io.Writer) io.Writer {
+	if jo.o.mode == outputStream {
+		return dst
+	}
+	return &jobWriter{jo, dst}
+}
+
+type jobWriter struct {
+	jo  *jobOutput
+	dst io.Writer
+}
+
+func (w *jobWriter) Write(p []byte) (int, error) {
+	w.jo.o.Lock()
+	defer w.jo.o.Unlock()
+	if w.jo.live {
+		return w.dst.Write(p)
+	}
+	w.jo.chunks = append(w.jo.chunks, outputChunk{w.dst, bytes.Clone(p)})
+	return len(p), nil
+}
+
+// Write out whatever the recipe's output holds, once the recipe is done. In
+// oldest mode, the next oldest recipe's output goes live.
+func (jo *jobOutput) finish() {
+	o := jo.o
+	o.Lock()
+	defer o.Unlock()
+	jo.flush()
+	i := slices.Index(o.running, jo)
+	o.running = slices.Delete(o.running, i, i+1)
+	if o.mode == outputOldest && jo.live && len(o.running) > 0 {
+		next := o.running[0]
+		next.flush()
+		next.live = true
+	}
+}
+
+// Write the held output. Called with the outputs locked.
+func (jo *jobOutput) flush() {
+	for _, c := range jo.chunks {
+		c.dst.Write(c.data)
+	}
+	jo.chunks = nil
+}
@@ -1,11 +1,10 @@
 // This is a mkfile parser. It executes assignments and includes as it goes, and
-// collects a set of rules, which are returned as a ruleSet object.
+// collects a set of rules, which are returned as a RuleSet object.
 
-package main
+package mk
 
 import (
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -17,23 +16,66 @@ type parser struct {
 	name       string   // name of the file being parsed
 	path       string   // full path of the file being parsed
 	tokenbuf   []token  // tokens consumed on the current statement
-	rules      *ruleSet // current ruleSet
+	rules      *RuleSet // current RuleSet
 	unexported bool     // next assignment is =U= (unexported)
 }
 
+// Record a diagnostic.
+func (p *parser) report(line, col int, msg string) {
+	p.rules.diags = append(p.rules.diags, Diagnostic{
+		File:     p.name,
+		Line:     line,
+		Col:      col,
+		Severity: SeverityError,
+		Message:  msg,
+	})
+}
+
 // Pretty errors.
 func (p *parser) parseError(context string, expected string, found token) {
-	mkError(fmt.Sprintf("%s:%d: syntax error: while %s, expected %s but found '%s'.",
-		p.name, found.line, context, expected, found.String()))
+	p.report(found.line, found.col+1, fmt.Sprintf("syntax error: while %s, expected %s but found '%s'.",
+		context, expected, found.String()))
 }
 
 // More basic errors.
 func (p *parser) basicErrorAtToken(what string, found token) {
-	p.basicErrorAtLine(what, found.line)
+	p.report(found.line, found.col+1, "syntax error: "+what)
 }
 
 func (p *parser) basicErrorAtLine(what string, line int) {
-	mkError(fmt.Sprintf("%s:%d: syntax error: %s\n", p.name, line, what))
+	p.report(line, 0, "syntax error: "+what)
+}
+
+// Recover from an error in a statement by skipping the rest of it, and its
+// recipe if it has one. The error was found at t.
+func (p *parser) recover(t token) parserStateFun {
+	p.clear()
+	p.unexported = false
+	if t.typ == tokenNewline {
+		return parseSkipRecipe
+	}
+	return parseSkipStatement
+}
+
+// Advance the parser by a token. An error raised while a statement is
+// executed, by a failing backtick say, is reported at the statement, which
+// is abandoned.
+func (p *parser) step(state parserStateFun, t token) (next parserStateFun) {
+	defer func() {
+		if r := recover(); r != nil {
+			fe, ok := r.(fatalError)
+			if !ok {
+				panic(r)
+			}
+			at := t
+			if len(p.tokenbuf) > 0 {
+				at = p.tokenbuf[0]
+			}
+			p.report(at.line, at.col+1, fe.err.Error())
+			next = p.recover(t)
+		}
+	}()
+	return state(p, t)
 }
 
 // Accept a token for use in the current statement being parsed.
@@ -47,44 +89,82 @@ func (p *parser) clear() {
 }
 
 // A parser state function takes a parser and the next token and returns a new
-// state function, or nil if there was a parse error.
+// state function.
 type parserStateFun func(*parser, token) parserStateFun
 
-// Parse a mkfile, returning a new ruleSet.
-func parse(input string, name string, path string, env map[string][]string) *ruleSet {
-	rules := &ruleSet{
+// Parse a mkfile, returning a new RuleSet. Recipes are run by the default
+// shell unless the mkfile names another. Errors found are recorded in the
+// RuleSet's diagnostics; what could be parsed around them is kept.
+func parse(input string, name string, path string, env map[string][]string) *RuleSet {
+	return parseWith(input, name, path, env, shellConfig{command: defaultShell})
+}
+
+// Parse a mkfile, as parse does, with the given default shell.
+func parseWith(input string, name string, path string, env map[string][]string, shell shellConfig) *RuleSet {
+	rules := &RuleSet{
 		vars:           env,
 		rules:          make([]rule, 0),
 		targetrules:    make(map[string][]int),
 		unexportedVars: make(map[string]bool),
+		shell:          shell,
 	}
 	parseInto(input, name, rules, path)
 	return rules
 }
 
 // Parse a mkfile inserting rules and variables into a given ruleSet.
-func parseInto(input string, name string, rules *ruleSet, path string) {
+func parseInto(input string, name string, rules *RuleSet, path string) {
 	l, tokens := lex(input)
+	// On a syntax error, let the lexer run to the end rather than leave it
+	// blocked forever.
+	defer func() {
+		for range tokens {
+		}
+	}()
 	p := &parser{l: l, name: name, path: path, tokenbuf: []token{}, rules: rules}
+	rules.files = append(rules.files, ParseSyntax(input, name))
 	oldmkfiledir := p.rules.vars["mkfiledir"]
 	p.rules.vars["mkfiledir"] = []string{filepath.Dir(path)}
 	state := parseTopLevel
 	for t := range tokens {
 		if t.typ == tokenError {
+			// The lexer gives up only at the end of the file, so there is
+			// nothing more to parse.
 			p.basicErrorAtLine(l.errmsg, t.line)
-			break
+			p.rules.vars["mkfiledir"] = oldmkfiledir
+			return
 		}
 
-		state = state(p, t)
+		state = p.step(state, t)
 	}
 
 	// insert a dummy newline to allow parsing of any assignments or recipeless
 	// rules to finish.
-	state = state(p, token{tokenNewline, "\n", l.line, l.col})
+	p.step(state, token{typ: tokenNewline, val: "\n", line: l.line, col: l.col, off: l.pos})
+
+	// A rule whose header ends with a line continuation is still waiting for
+	// its recipe.
+	if len(p.tokenbuf) > 0 {
+		p.basicErrorAtToken("end of file encountered in an unterminated statement", p.tokenbuf[0])
+	}
 
 	p.rules.vars["mkfiledir"] = oldmkfiledir
+}
 
-	// TODO: Error when state != parseTopLevel
+// Skip the rest of a statement with an error in it.
+func parseSkipStatement(p *parser, t token) parserStateFun {
+	if t.typ == tokenNewline {
+		return parseSkipRecipe
+	}
+	return parseSkipStatement
+}
+
+// Skip the recipe of a rule with an error in its header, if it has one.
+func parseSkipRecipe(p *parser, t token) parserStateFun {
+	if t.typ == tokenRecipe {
+		return parseTopLevel
+	}
+	return parseTopLevel(p, t)
 }
 
 // We are at the top level of a mkfile, expecting rules, assignments, or
@@ -102,7 +182,7 @@ func parseTopLevel(p *parser, t token) parserStateFun {
 	default:
 		p.parseError("parsing mkfile",
 			"a rule, include, or assignment", t)
-		return parseTopLevel
+		return p.recover(t)
 	}
 }
 
@@ -123,20 +203,27 @@ func parsePipeInclude(p *parser, t token) parserStateFun {
 	case tokenNewline:
 		if len(p.tokenbuf) == 0 {
 			p.basicErrorAtToken("empty pipe include", t)
+			return parseTopLevel
 		}
 		args := make([]string, 0, len(p.tokenbuf))
 		for _, tk := range p.tokenbuf {
 			// TODO(rjk): Do we need to expand backticks here?
-			args = append(args, expand(tk.val, p.rules.vars, false)...)
+			args = append(args, expand(tk.val, p.rules.vars, nil)...)
+		}
+
+		if p.rules.shell.norun {
+			p.rules.unread = append(p.rules.unread, prettyPipeIncludeName(args))
+			p.clear()
+			return parseTopLevel
 		}
 
 		// TODO(rjk): determine what env should be in comparison with p9p.
-		output, success := subprocess(args[0], args[1:], nil, "", true)
+		output, success := subprocess(nil, args[0], args[1:], nil, p.rules.shell.dir, "", true, nil)
 		if !success {
-			p.basicErrorAtToken("subprocess include failed", t)
+			p.basicErrorAtToken("subprocess include failed", p.tokenbuf[0])
+		} else {
+			parseInto(output, prettyPipeIncludeName(args), p.rules, p.path)
 		}
-
-		parseInto(output, prettyPipeIncludeName(args), p.rules, p.path)
 		p.clear()
 		return parseTopLevel
 	// Almost anything goes. Let the shell sort it out.
@@ -153,6 +240,7 @@ func parsePipeInclude(p *parser, t token) parserStateFun {
 
 	default:
 		p.parseError("parsing piped include", "a shell command", t)
+		return p.recover(t)
 	}
 
 	return parsePipeInclude
@@ -167,25 +255,35 @@ func parseRedirInclude(p *parser, t token) parserStateFun {
 			filename += p.tokenbuf[i].val
 		}
 
+		if len(p.tokenbuf) == 0 {
+			p.basicErrorAtToken("empty include", t)
+			return parseTopLevel
+		}
+
 		// Expand variables in paths.
-		parts := expand(filename, p.rules.vars, false)
+		parts := expand(filename, p.rules.vars, nil)
 		if len(parts) != 1 {
-			mkError("filename variables need to be a single value")
+			p.basicErrorAtToken("filename variables need to be a single value", p.tokenbuf[0])
+			p.clear()
+			return parseTopLevel
 		}
 
 		// TODO(rjk): Be sure that this is the right behaviour.
 		filename = parts[0]
+		if p.rules.shell.norun {
+			p.rules.unread = append(p.rules.unread, "<"+filename)
+			p.clear()
+			return parseTopLevel
+		}
 
-		file, err := os.Open(filename)
+		wd := workDir{dir: p.rules.shell.dir}
+		input, err := os.ReadFile(wd.path(filename))
 		if err != nil {
 			p.basicErrorAtToken(fmt.Sprintf("cannot open %s", filename), p.tokenbuf[0])
+		} else {
+			path, _ := filepath.Abs(wd.path(filename))
+			parseInto(string(input), filename, p.rules, path)
 		}
-		input, _ := io.ReadAll(file) // ReadAll on a regular file; error is not practically reachable.
-		file.Close()
-
-		path, _ := filepath.Abs(filename)
-
-		parseInto(string(input), filename, p.rules, path)
 
 		p.clear()
 		return parseTopLevel
@@ -195,6 +293,7 @@ func parseRedirInclude(p *parser, t token) parserStateFun {
 
 	default:
 		p.parseError("parsing include", "a file name", t)
+		return p.recover(t)
 	}
 
 	return parseRedirInclude
@@ -227,7 +326,7 @@ func parseEqualsOrTarget(p *parser, t token) parserStateFun {
 	default:
 		p.parseError("reading a target or assignment",
 			"'=', ':', or another target", t)
-		return parseTopLevel
+		return p.recover(t)
 	}
 }
 
@@ -262,6 +361,7 @@ func parseTargets(p *parser, t token) parserStateFun {
 	default:
 		p.parseError("reading a rule's targets",
 			"filename or pattern", t)
+		return p.recover(t)
 	}
 
 	return parseTargets
@@ -280,6 +380,7 @@ func parseAttributesOrPrereqs(p *parser, t token) parserStateFun {
 	default:
 		p.parseError("reading a rule's attributes or prerequisites",
 			"an attribute, pattern, or filename", t)
+		return p.recover(t)
 	}
 
 	return parseAttributesOrPrereqs
@@ -296,6 +397,7 @@ func parsePrereqs(p *parser, t token) parserStateFun {
 	default:
 		p.parseError("reading a rule's prerequisites",
 			"filename or pattern", t)
+		return p.recover(t)
 	}
 
 	return parsePrereqs
@@ -303,8 +405,9 @@ func parsePrereqs(p *parser, t token) parserStateFun {
 
 // An entire rule has been consumed.
 func parseRecipe(p *parser, t token) parserStateFun {
-	// Assemble the rule!
-	r := rule{}
+	// Assemble the rule! A rule with errors in it is reported and left out.
+	r := rule{file: p.name, line: p.tokenbuf[0].line}
+	ok := true
 
 	// find one or two colons
 	i := 0
@@ -318,22 +421,14 @@ func parseRecipe(p *parser, t token) parserStateFun {
 	if j < len(p.tokenbuf) {
 		attribs := make([]string, 0)
 		for k := i + 1; k < j; k++ {
-			exparts := expand(p.tokenbuf[k].val, p.rules.vars, true)
+			exparts := expand(p.tokenbuf[k].val, p.rules.vars, p.rules.backticks())
 			attribs = append(attribs, exparts...)
 		}
 		err := r.parseAttribs(attribs)
 		if err != nil {
 			msg := fmt.Sprintf("while reading a rule's attributes expected an attribute but found \"%c\".", err.found)
 			p.basicErrorAtToken(msg, p.tokenbuf[i+1])
-		}
-
-		// If we don't have a shell set, check vars, check default shell
-		if r.shell == nil {
-			if len(p.rules.vars["shell"]) > 0 {
-				r.shell = p.rules.vars["shell"]
-			} else {
-				r.shell = []string{defaultShell}
-			}
+			ok = false
 		}
 
 		if r.attributes.regex {
@@ -343,10 +438,19 @@ func parseRecipe(p *parser, t token) parserStateFun {
 		j = i
 	}
 
+	// If we don't have a shell set, check vars, check default shell
+	if r.shell == nil {
+		if sh := varsShell(p.rules.vars); len(sh) > 0 {
+			r.shell = sh
+		} else {
+			r.shell = []string{p.rules.shell.command}
+		}
+	}
+
 	// targets
 	r.targets = make([]pattern, 0)
 	for k := 0; k < i; k++ {
-		exparts := expand(p.tokenbuf[k].val, p.rules.vars, true)
+		exparts := expand(p.tokenbuf[k].val, p.rules.vars, p.rules.backticks())
 		for ei := range exparts {
 			targetstr := exparts[ei]
 			r.targets = append(r.targets, pattern{spat: targetstr})
@@ -356,6 +460,7 @@ func parseRecipe(p *parser, t token) parserStateFun {
 				if err != nil {
 					msg := fmt.Sprintf("invalid regular expression: %q", err)
 					p.basicErrorAtToken(msg, p.tokenbuf[k])
+					ok = false
 				}
 				r.targets[len(r.targets)-1].rpat = rpat
 			} else {
@@ -383,6 +488,8 @@ func parseRecipe(p *parser, t token) parserStateFun {
 					rpat := regexp.MustCompile(patstr) // QuoteMeta output is always valid regex
 					r.targets[len(r.targets)-1].rpat = rpat
 					r.targets[len(r.targets)-1].issuffix = true
+					r.targets[len(r.targets)-1].prefix = targetstr[:idx]
+					r.targets[len(r.targets)-1].suffix = targetstr[idx+1:]
 					r.ismeta = true
 				}
 			}
@@ -392,7 +499,7 @@ func parseRecipe(p *parser, t token) parserStateFun {
 	// prereqs
 	r.prereqs = make([]string, 0)
 	for k := j + 1; k < len(p.tokenbuf); k++ {
-		exparts := expand(p.tokenbuf[k].val, p.rules.vars, true)
+		exparts := expand(p.tokenbuf[k].val, p.rules.vars, p.rules.backticks())
 		r.prereqs = append(r.prereqs, exparts...)
 	}
 
@@ -400,7 +507,9 @@ func parseRecipe(p *parser, t token) parserStateFun {
 		r.recipe = stripIndentation(t.val, t.col)
 	}
 
-	p.rules.add(r)
+	if ok {
+		p.rules.add(r)
+	}
 	p.clear()
 
 	// the current token doesn't belong to this rule
@@ -1,6 +1,10 @@
-package main
+package mk
 
-import "testing"
+import (
+	"slices"
+	"strings"
+	"testing"
+)
 
 // Test a mkfile with a single rule. The target has a single
 // prerequesite; both are local files.
@@ -174,3 +178,58 @@ func TestParseLocalRegexPrereq(t *testing.T) {
 		t.Error("The rule does not have the right prerequisite")
 	}
 }
+
+// Every error is reported, and the statements around them are kept.
+func TestParseDiagnostics(t *testing.T) {
+	mkfile := "a: b\n" +
+		":\n" +
+		"1bad = v\n" +
+		"c:Z:\n" +
+		"\trecipe of c\n" +
+		"d: e\n" +
+		"\trecipe of d\n" +
+		"f: g\\\n"
+	ruleSet := parse(mkfile, "mkfile", "/mkfile", map[string][]string{})
+
+	want := []struct {
+		line, col int
+		msg       string
+	}{
+		{2, 1, "expected a rule, include, or assignment but found ':'"},
+		{3, 1, "not a valid variable name"},
+		{4, 3, "expected an attribute"},
+		{8, 1, "unterminated statement"},
+	}
+	if len(ruleSet.diags) != len(want) {
+		t.Fatalf("got %d diagnostics, want %d:\n%v", len(ruleSet.diags), len(want), ruleSet.diags)
+	}
+	for i, w := range want {
+		d := ruleSet.diags[i]
+		if d.File != "mkfile" || d.Line != w.line || d.Col != w.col || d.Severity != SeverityError ||
+			!strings.Contains(d.Message, w.msg) {
+			t.Errorf("diagnostic %d = %v, want mkfile:%d:%d: ...%s...", i, d, w.line, w.col, w.msg)
+		}
+	}
+
+	var targets []string
+	for _, r := range ruleSet.rules {
+		targets = append(targets, r.targets[0].spat)
+	}
+	if !slices.Equal(targets, []string{"a", "d"}) {
+		t.Errorf("rules for %v, want [a d]", targets)
+	}
+	if d := ruleSet.rules[1]; d.recipe != "recipe of d\n" {
+		t.Errorf("recipe of d = %q", d.recipe)
+	}
+}
+
+// A syntax error in a rule's header skips its recipe too.
+func TestParseSkipsRecipeAfterError(t *testing.T) {
+	ruleSet := parse("a b < c\n\trecipe\nd:\n\trecipe of d\n", "mkfile", "/mkfile", map[string][]string{})
+	if len(ruleSet.diags) != 1 || ruleSet.diags[0].Line != 1 || ruleSet.diags[0].Col != 5 {
+		t.Errorf("diagnostics = %v, want one at 1:5", ruleSet.diags)
+	}
+	if len(ruleSet.rules) != 1 || ruleSet.rules[0].targets[0].spat != "d" {
+		t.Errorf("want only the rule for d")
+	}
+}
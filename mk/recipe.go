@@ -0,0 +1,360 @@
+// Various functions for dealing with recipes.
+
+package mk
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Try to unindent a recipe, so that it begins an column 0. (This is mainly for
+// recipes in python, or other indentation-significant languages.)
+func stripIndentation(s string, mincol int) string {
+	// trim leading whitespace
+	reader := bufio.NewReader(strings.NewReader(s))
+	output := ""
+	for {
+		line, err := reader.ReadString('\n')
+		col := 0
+		i := 0
+		for i < len(line) && col < mincol {
+			c, w := utf8.DecodeRuneInString(line[i:])
+			if strings.ContainsRune(" \t\n", c) {
+				col += 1
+				i += w
+			} else {
+				break
+			}
+		}
+		output += line[i:]
+
+		if err != nil {
+			break
+		}
+	}
+
+	return output
+}
+
+// Indent each line of a recipe.
+func printIndented(out io.Writer, s string, ind int) {
+	indentation := strings.Repeat(" ", ind)
+	reader := bufio.NewReader(strings.NewReader(s))
+	firstline := true
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			if !firstline {
+				io.WriteString(out, indentation)
+			}
+			io.WriteString(out, line)
+		}
+		if err != nil {
+			break
+		}
+		firstline = false
+	}
+}
+
+// Set up the variables available to a recipe.
+func recipeVars(n *node, e *edge, opts *buildOpts, slots []int) map[string][]string {
+	vars := maps.Clone(opts.vars)
+	vars["target"] = []string{n.name}
+	vars["nproc"] = make([]string, len(slots))
+	for i, slot := range slots {
+		vars["nproc"][i] = fmt.Sprintf("%d", slot)
+	}
+	vars["pid"] = []string{fmt.Sprintf("%d", os.Getpid())}
+	if e.r.ismeta {
+		if e.r.attributes.regex {
+			for i := range e.matches {
+				vars[fmt.Sprintf("stem%d", i)] = e.matches[i : i+1]
+			}
+		} else {
+			vars["stem"] = []string{e.stem}
+		}
+	}
+
+	// alltarget: all targets of the rule
+	alltarget := make([]string, 0, len(e.r.targets))
+	for i := range e.r.targets {
+		alltarget = append(alltarget, e.r.targets[i].spat)
+	}
+	vars["alltarget"] = alltarget
+
+	prereqs := make([]string, 0)
+	newprereq := make([]string, 0)
+	newmember := make([]string, 0)
+	prereqCount := 0
+	for i := range n.prereqs {
+		if n.prereqs[i].v != nil {
+			prereqs = append(prereqs, n.prereqs[i].v.name)
+			prereqCount++
+			vars[fmt.Sprintf("prereq%d", prereqCount)] = []string{n.prereqs[i].v.name}
+			// newprereq: prereqs that were rebuilt (out of date)
+			if n.prereqs[i].v.status == nodeStatusDone {
+				newprereq = append(newprereq, n.prereqs[i].v.name)
+				// newmember: the members named by lib(member) prereqs in newprereq
+				if _, member, ok := splitMember(n.prereqs[i].v.name); ok {
+					newmember = append(newmember, member)
+				}
+			}
+		}
+	}
+	vars["prereq"] = prereqs
+	vars["newprereq"] = newprereq
+	vars["newmember"] = newmember
+
+	sh, args, _ := recipeShell(e, opts.shell)
+	vars["shell"] = append([]string{sh}, args...)
+	return vars
+}
+
+// Return the shell and its arguments for running a rule's recipe.
+func recipeShell(e *edge, shell shellConfig) (string, []string, *shellType) {
+	sh, args := shell.split(shell.command, []string{})
+	if len(e.r.shell) > 0 {
+		sh, args = shell.split(e.r.shell[0], e.r.shell[1:])
+	}
+	st := shellTypeOf(sh)
+	// E attribute: don't pass -e to the shell (allow recipe to continue on errors).
+	// Allocate a new slice to avoid mutating e.r.shell's backing array.
+	// Otherwise, as in Plan 9, known shells always stop at the first failing
+	// command, even when expandShell dropped the flag.
+	if e.r.attributes.nonstop {
+		filtered := make([]string, 0, len(args))
+		for _, a := range args {
+			if a != "-e" && a != st.errflag {
+				filtered = append(filtered, a)
+			}
+		}
+		args = filtered
+	} else if st.errflag != "" && !slices.Contains(args, st.errflag) {
+		args = append([]string{st.errflag}, args...)
+	}
+	return sh, args, st
+}
+
+// Variables whose values differ from run to run without any change to the
+// build, left unexpanded when comparing recipes with the build database.
+var volatileRecipeVars = []string{"nproc", "pid", "newprereq", "newmember"}
+
+// Describe a recipe as it would be run, for comparison with the record in the
+// build database.
+func recipeSignature(n *node, e *edge, opts *buildOpts) *recipeRecord {
+	vars := recipeVars(n, e, opts, []int{0})
+	for _, k := range volatileRecipeVars {
+		vars[k] = []string{"$" + k}
+	}
+
+	st := shellTypeOf(vars["shell"][0])
+	sig := &recipeRecord{
+		Recipe: st.expandRecipe(e.r.recipe, vars),
+		Shell:  vars["shell"],
+	}
+	// Exported variables the recipe refers to, which its commands may also
+	// read from the environment.
+	for _, k := range recipeVarRefs(e.r.recipe) {
+		v, ok := opts.vars[k]
+		if !ok || opts.unexportedVars[k] {
+			continue
+		}
+		if sig.Vars == nil {
+			sig.Vars = make(map[string]string)
+		}
+		sig.Vars[k] = st.join(v)
+	}
+	return sig
+}
+
+// The outcome of running a node's recipe.
+type recipeRun struct {
+	rule     *rule
+	slots    int           // job slots held
+	status   string        // ok, failed, timeout or aborted
+	exitCode int           // of the last attempt; -1 if it was killed
+	timeout  time.Duration // the limit, if it timed out
+	duration time.Duration // of every attempt
+}
+
+// Execute a recipe.
+func dorecipe(n *node, e *edge, opts *buildOpts, slots []int) bool {
+	vars := recipeVars(n, e, opts, slots)
+	sh, args := vars["shell"][0], vars["shell"][1:]
+	st := shellTypeOf(sh)
+
+	// Build the command.
+	input := st.expandRecipe(e.r.recipe, vars)
+
+	out := opts.outputs.start()
+	opts.printRecipe(out.writer(opts.Stdout), n.name, input, e.r.attributes.quiet)
+	if opts.DryRun {
+		out.finish()
+		return true
+	}
+
+	// Construct the execution environment for this recipe.
+	env := os.Environ()
+	for k, v := range vars {
+		// =U= variables are available for mk expansion but not exported to recipes.
+		if opts.unexportedVars[k] {
+			continue
+		}
+		env = append(env, k+"="+st.join(v))
+	}
+
+	// If the recipe is stopped, a file target it may have half written is
+	// deleted.
+	rp := &runningProc{
+		name:    n.name,
+		file:    n.name,
+		path:    opts.wd.path(n.name),
+		timeout: opts.Timeout,
+		stdout:  out.writer(opts.Stdout),
+		stderr:  out.writer(opts.Stderr),
+	}
+	if e.r.attributes.virtual {
+		rp.file = ""
+	}
+	if e.r.attributes.timeout > 0 {
+		rp.timeout = e.r.attributes.timeout
+	}
+	opts.events.emit(event{Type: eventRecipeStart, Target: n.name, Recipe: input, Slots: slots})
+	start := time.Now()
+	_, success := subprocess(
+		opts.procs,
+		sh,
+		args,
+		env,
+		opts.Dir,
+		input,
+		false,
+		rp)
+	out.finish()
+	if opts.procs.isInterrupted() {
+		// The build is over; its targets are dealt with as a whole.
+		return false
+	}
+	if rp.aborted {
+		rp.removeChanged(opts.Stderr)
+	}
+	if rp.timedOut {
+		opts.printError(fmt.Sprintf("recipe for %s timed out after %s", n.name, rp.timeout))
+	}
+
+	status := "ok"
+	switch {
+	case rp.timedOut:
+		status = "timeout"
+	case rp.aborted:
+		status = "aborted"
+	case !success:
+		status = "failed"
+	}
+	opts.events.emit(event{
+		Type:     eventRecipeFinish,
+		Target:   n.name,
+		ExitCode: &rp.exitCode,
+		Duration: time.Since(start).Seconds(),
+		Status:   status,
+	})
+	held := slots
+	if e.r.attributes.exclusive {
+		// An exclusive recipe holds every slot.
+		held = make([]int, opts.sched.allowed)
+		for i := range held {
+			held[i] = i
+		}
+	}
+	opts.trace.recipe(n.name, held, start, time.Now(), status)
+
+	if n.run == nil {
+		n.run = &recipeRun{rule: e.r, slots: len(held)}
+	}
+	n.run.status, n.run.exitCode = status, rp.exitCode
+	if rp.timedOut {
+		n.run.timeout = rp.timeout
+	}
+	n.run.duration += time.Since(start)
+
+	return success
+}
+
+// Execute a subprocess (typically a recipe).
+//
+// Args:
+//
+//	procs: The build's subprocesses, to which this one is added while it
+//	    runs; nil for one run outside a build, like a backtick.
+//	program: Program path or name located in PATH
+//	dir: Directory the program runs in; "" for the process's working directory
+//	input: String piped into the program's stdin
+//	captureOut: If true, capture and return the program's stdout rather than echoing it.
+//	rp: The recipe the program runs, stopped if the build is interrupted; nil if none.
+//
+// Returns (output, success) where output is the captured stdout (empty if
+// captureOut is false) and success indicates a zero exit code.
+func subprocess(procs *procTable,
+	program string,
+	args []string,
+	env []string,
+	dir string,
+	input string,
+	captureOut bool,
+	rp *runningProc,
+) (string, bool) {
+	cmd := exec.Command(program, args...)
+	cmd.Env = env
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if procs != nil {
+		cmd.Stdout, cmd.Stderr = procs.stdout, procs.stderr
+	}
+	if rp != nil && rp.stderr != nil {
+		cmd.Stderr = rp.stderr
+	}
+
+	var stdout bytes.Buffer
+	if captureOut {
+		cmd.Stdout = &stdout
+	} else if rp != nil && rp.stdout != nil {
+		cmd.Stdout = rp.stdout
+	}
+
+	if rp != nil {
+		rp.exitCode = -1
+	}
+	var err error
+	if procs == nil {
+		err = cmd.Run()
+	} else if err = procs.start(cmd, rp); err == nil {
+		err = cmd.Wait()
+		if rp != nil {
+			rp.exitCode = cmd.ProcessState.ExitCode()
+		}
+		procs.finish(cmd)
+	}
+	if errors.Is(err, errAborted) || errors.Is(err, errInterrupted) {
+		return "", false
+	}
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			// The program couldn't be run at all.
+			fmt.Fprintf(cmd.Stderr, "mk: %s\n", err)
+		}
+		return stdout.String(), false
+	}
+	return stdout.String(), true
+}
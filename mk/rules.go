@@ -0,0 +1,418 @@
+// Mkfiles are parsed into ruleSets, which as the name suggests, are sets of
+// rules with accompanying recipes, as well as assigned variables which are
+// expanding when evaluating rules and recipes.
+
+package mk
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+type attribSet struct {
+	delFailed       bool          // delete targets when the recipe fails
+	nonstop         bool          // don't stop if the recipe fails
+	forcedTimestamp bool          // N: target need not exist and has no recipe
+	nonvirtual      bool          // a meta-rule that will only match files
+	quiet           bool          // don't print the recipe
+	regex           bool          // regular expression meta-rule
+	update          bool          // treat the targets as if they were updated
+	virtual         bool          // rule is virtual (does not match files)
+	exclusive       bool          // don't execute concurrently with any other rule
+	hash            bool          // compare content digests instead of timestamps
+	weight          int           // J: number of job slots the recipe occupies
+	pool            string        // L: name of the pool limiting concurrent recipes
+	timeout         time.Duration // T: how long the recipe may run before it's killed
+	retries         int           // A: times to run the recipe again if it fails
+	backoff         time.Duration // A: wait before the first retry, doubling after
+}
+
+// Error parsing an attribute
+type attribError struct {
+	found rune
+}
+
+// target and rereq patterns
+type pattern struct {
+	issuffix bool           // is a suffix '%' rule, so we should define $stem.
+	spat     string         // simple string pattern
+	rpat     *regexp.Regexp // non-nil if this is a regexp pattern
+	prefix   string         // for a suffix rule, the text before the '%' or '&'
+	suffix   string         // for a suffix rule, the text after it
+}
+
+// Match a pattern, returning an array of submatches,
+// or nil if it doesn't match.
+func (p *pattern) match(target string) []string {
+	if p.rpat != nil {
+		return p.rpat.FindStringSubmatch(target)
+	}
+
+	if target == p.spat {
+		return make([]string, 0)
+	}
+
+	return nil
+}
+
+// A single rule.
+type rule struct {
+	targets    []pattern // non-empty array of targets
+	attributes attribSet // rule attributes
+	prereqs    []string  // possibly empty prerequesites
+	shell      []string  // command used to execute the recipe
+	recipe     string    // recipe source
+	command    []string  // command attribute
+	ismeta     bool      // is this a meta rule
+	file       string    // file where the rule is defined
+	line       int       // line number on which the rule is defined
+}
+
+// Identical rule headers: same targets, attributes, and prerequisites.
+func (r *rule) sameHeader(r2 *rule) bool {
+	if len(r.targets) != len(r2.targets) {
+		return false
+	}
+	for i := range r.targets {
+		if r.targets[i].spat != r2.targets[i].spat {
+			return false
+		}
+	}
+	if r.attributes != r2.attributes {
+		return false
+	}
+	if len(r.prereqs) != len(r2.prereqs) {
+		return false
+	}
+	for i := range r.prereqs {
+		if r.prereqs[i] != r2.prereqs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Equivalent recipes.
+func (r *rule) equivRecipe(r2 *rule) bool {
+	if r.recipe != r2.recipe {
+		return false
+	}
+
+	if len(r.shell) != len(r2.shell) {
+		return false
+	}
+
+	for i := range r.shell {
+		if r.shell[i] != r2.shell[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// A parsed mkfile: its rules and variables. Made by Parse, and built by Build.
+type RuleSet struct {
+	vars  map[string][]string
+	rules []rule
+	// map a target to an array of indexes into rules
+	targetrules    map[string][]int
+	meta           metaIndex           // the targets of meta-rules
+	shell          shellConfig         // the shell when the mkfile names none
+	unexportedVars map[string]bool     // variables marked with =U= (not exported to recipe env)
+	diags          Diagnostics         // problems found parsing the mkfile
+	files          []*File             // the mkfile and those it includes, as written
+	env            map[string][]string // the environment it was parsed in
+	unread         []string            // includes neither read nor run, with shell.norun
+}
+
+// Return the shell to run backticks with, or nil if they aren't run.
+func (rs *RuleSet) backticks() *shellConfig {
+	if rs.shell.norun {
+		return nil
+	}
+	return &rs.shell
+}
+
+// Read attributes for an array of strings, updating the rule.
+func (r *rule) parseAttribs(inputs []string) *attribError {
+	for i := 0; i < len(inputs); i++ {
+		input := inputs[i]
+		pos := 0
+		for pos < len(input) {
+			c, w := utf8.DecodeRuneInString(input[pos:])
+			switch c {
+			case 'D':
+				r.attributes.delFailed = true
+			case 'H':
+				r.attributes.hash = true
+			case 'E':
+				r.attributes.nonstop = true
+			case 'N':
+				r.attributes.forcedTimestamp = true
+			case 'n':
+				r.attributes.nonvirtual = true
+			case 'Q':
+				r.attributes.quiet = true
+			case 'R':
+				r.attributes.regex = true
+			case 'U':
+				r.attributes.update = true
+			case 'V':
+				r.attributes.virtual = true
+			case 'X':
+				r.attributes.exclusive = true
+			case 'J':
+				j := pos + w
+				for j < len(input) && isdigit(rune(input[j])) {
+					j++
+				}
+				weight, err := strconv.Atoi(input[pos+w : j])
+				if err != nil || weight < 1 {
+					return &attribError{c}
+				}
+				r.attributes.weight = weight
+				pos = j
+				continue
+			case 'L':
+				// The pool name runs to the end of the word.
+				if pos+w >= len(input) {
+					return &attribError{c}
+				}
+				r.attributes.pool = input[pos+w:]
+				pos = len(input)
+				continue
+
+			case 'A':
+				// A count of retries, optionally followed by /backoff, which
+				// runs to the end of the word.
+				j := pos + w
+				for j < len(input) && isdigit(rune(input[j])) {
+					j++
+				}
+				retries, err := strconv.Atoi(input[pos+w : j])
+				if err != nil || retries < 1 {
+					return &attribError{c}
+				}
+				r.attributes.retries = retries
+				if j < len(input) && input[j] == '/' {
+					backoff, err := time.ParseDuration(input[j+1:])
+					if err != nil || backoff <= 0 {
+						return &attribError{c}
+					}
+					r.attributes.backoff = backoff
+					j = len(input)
+				}
+				pos = j
+				continue
+
+			case 'T':
+				// The duration runs to the end of the word.
+				timeout, err := time.ParseDuration(input[pos+w:])
+				if err != nil || timeout <= 0 {
+					return &attribError{c}
+				}
+				r.attributes.timeout = timeout
+				pos = len(input)
+				continue
+
+			case 'P':
+				if pos+w < len(input) {
+					r.command = append(r.command, input[pos+w:])
+				}
+				r.command = append(r.command, inputs[i+1:]...)
+				return nil
+
+			case 'S':
+				if pos+w < len(input) {
+					r.shell = append(r.shell, input[pos+w:])
+				}
+				r.shell = append(r.shell, inputs[i+1:]...)
+				return nil
+
+			default:
+				return &attribError{c}
+			}
+
+			pos += w
+		}
+	}
+
+	return nil
+}
+
+// Add a rule to the rule set.
+// If a rule with an identical header (targets, attributes, prerequisites) and
+// a recipe already exists, the new rule replaces it (Plan 9 convention), with
+// a warning.
+func (rs *RuleSet) add(r rule) {
+	if r.recipe != "" {
+		for i := range rs.rules {
+			if rs.rules[i].recipe != "" && r.sameHeader(&rs.rules[i]) {
+				old := &rs.rules[i]
+				rs.diags = append(rs.diags, Diagnostic{
+					File:     old.file,
+					Line:     old.line,
+					Severity: SeverityWarning,
+					Message:  fmt.Sprintf("recipe is replaced by the rule at %s:%d", r.file, r.line),
+				})
+				rs.rules[i] = r
+				return
+			}
+		}
+	}
+	rs.rules = append(rs.rules, r)
+	k := len(rs.rules) - 1
+	for i := range r.targets {
+		if r.targets[i].rpat == nil {
+			rs.targetrules[r.targets[i].spat] = append(rs.targetrules[r.targets[i].spat], k)
+		}
+	}
+	if r.ismeta {
+		rs.meta.add(k, &r)
+	}
+}
+
+// A target of a meta-rule: the indexes of the rule and of the target in it.
+type metaTarget struct {
+	rule, target int
+}
+
+// The literal text either side of the '%' or '&' of a suffix rule's target.
+type affixes struct {
+	prefix, suffix string
+}
+
+// The targets of meta-rules, indexed so those that may match a name are found
+// without trying all of them. Suffix rule targets are kept by their prefix and
+// suffix, of which a name has only as many as there are distinct lengths of
+// them; other targets of meta-rules by their name. Regular expressions can't
+// be indexed, and are tried on every name.
+type metaIndex struct {
+	affixed map[affixes][]metaTarget
+	lengths [][2]int // distinct lengths of prefixes and suffixes in affixed
+	literal map[string][]metaTarget
+	regex   []metaTarget
+}
+
+// Index the targets of the meta-rule with index k.
+func (mi *metaIndex) add(k int, r *rule) {
+	if mi.affixed == nil {
+		mi.affixed = make(map[affixes][]metaTarget)
+		mi.literal = make(map[string][]metaTarget)
+	}
+	for j := range r.targets {
+		t := &r.targets[j]
+		m := metaTarget{k, j}
+		switch {
+		case r.attributes.regex:
+			mi.regex = append(mi.regex, m)
+		case t.issuffix:
+			a := affixes{t.prefix, t.suffix}
+			mi.affixed[a] = append(mi.affixed[a], m)
+			l := [2]int{len(t.prefix), len(t.suffix)}
+			if !slices.Contains(mi.lengths, l) {
+				mi.lengths = append(mi.lengths, l)
+			}
+		default:
+			mi.literal[t.spat] = append(mi.literal[t.spat], m)
+		}
+	}
+}
+
+// Return the meta-rule targets that may match a name, in the order the rules
+// and their targets were defined. Each still has to be matched.
+func (mi *metaIndex) candidates(name string) []metaTarget {
+	ms := slices.Clone(mi.regex)
+	ms = append(ms, mi.literal[name]...)
+	for _, l := range mi.lengths {
+		// The stem is at least one character.
+		if l[0]+l[1] < len(name) {
+			ms = append(ms, mi.affixed[affixes{name[:l[0]], name[len(name)-l[1]:]}]...)
+		}
+	}
+	slices.SortFunc(ms, func(a, b metaTarget) int {
+		return cmp.Or(cmp.Compare(a.rule, b.rule), cmp.Compare(a.target, b.target))
+	})
+	return ms
+}
+
+func isValidVarName(v string) bool {
+	if len(v) == 0 {
+		return false
+	}
+	for i := 0; i < len(v); {
+		c, w := utf8.DecodeRuneInString(v[i:])
+		if i == 0 && !(isalpha(c) || c == '_') {
+			return false
+		} else if !(isalnum(c) || c == '_') {
+			return false
+		}
+		i += w
+	}
+	return true
+}
+
+func isdigit(c rune) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isalpha(c rune) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isalnum(c rune) bool {
+	return isalpha(c) || isdigit(c)
+}
+
+type assignmentError struct {
+	what  string
+	where token
+}
+
+// Parse and execute assignment operation.
+// If unexported is true, the variable is marked as not exported to recipe environments.
+func (rs *RuleSet) executeAssignment(ts []token, unexported bool) *assignmentError {
+	assignee := ts[0].val
+	if !isValidVarName(assignee) {
+		return &assignmentError{
+			fmt.Sprintf("target of assignment is not a valid variable name: \"%s\"", assignee),
+			ts[0],
+		}
+	}
+
+	// interpret tokens in assignment context
+	input := make([]string, 0)
+	for i := 1; i < len(ts); i++ {
+		if ts[i].typ != tokenWord || (i > 1 && ts[i-1].typ != tokenWord) {
+			if len(input) == 0 {
+				input = append(input, ts[i].val)
+			} else {
+				input[len(input)-1] += ts[i].val
+			}
+		} else {
+			input = append(input, ts[i].val)
+		}
+	}
+
+	// expanded variables
+	vals := make([]string, 0)
+	for i := 0; i < len(input); i++ {
+		vals = append(vals, expand(input[i], rs.vars, rs.backticks())...)
+	}
+
+	rs.vars[assignee] = vals
+
+	if unexported {
+		rs.unexportedVars[assignee] = true
+	} else {
+		delete(rs.unexportedVars, assignee)
+	}
+
+	return nil
+}
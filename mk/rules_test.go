@@ -1,10 +1,12 @@
-package main
+package mk
 
 import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMatchMetaRule(t *testing.T) {
@@ -12,7 +14,7 @@ func TestMatchMetaRule(t *testing.T) {
 	if err != nil {
 		t.Error("Failure to compile regex pattern")
 	}
-	pat := pattern{false, "data/processed/(\\d+)/mapping_k10.bam.bai", regex}
+	pat := pattern{spat: "data/processed/(\\d+)/mapping_k10.bam.bai", rpat: regex}
 	matches := pat.match("data/processed/12345/mapping_k10.bam.bai")
 	want := []string{"data/processed/12345/mapping_k10.bam.bai", "12345"}
 	if matches[0] != want[0] || matches[1] != want[1] {
@@ -119,7 +121,7 @@ func TestExecuteAssignment(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			rs := &ruleSet{
+			rs := &RuleSet{
 				vars:           map[string][]string{},
 				rules:          []rule{},
 				targetrules:    map[string][]int{},
@@ -146,9 +148,9 @@ func TestExecuteAssignment(t *testing.T) {
 
 func TestIsValidVarName(t *testing.T) {
 	tests := []struct {
-		name string
+		name  string
 		input string
-		want bool
+		want  bool
 	}{
 		{"alpha", "foo", true},
 		{"underscore_prefix", "_bar", true},
@@ -170,15 +172,15 @@ func TestIsValidVarName(t *testing.T) {
 func ruleAttributesNotSet(t *testing.T, r *rule) {
 	t.Helper()
 	noAttributes := attribSet{
-		delFailed:      false,
-		nonstop:        false,
+		delFailed:       false,
+		nonstop:         false,
 		forcedTimestamp: false,
-		nonvirtual:     false,
-		quiet:          false,
-		regex:          false,
-		update:         false,
-		virtual:        false,
-		exclusive:      false,
+		nonvirtual:      false,
+		quiet:           false,
+		regex:           false,
+		update:          false,
+		virtual:         false,
+		exclusive:       false,
 	}
 	if r.attributes != noAttributes {
 		t.Error("rule attributes are not all false", r.attributes)
@@ -226,3 +228,129 @@ func TestParseOneRuleWithAttributeLocalFiles(t *testing.T) {
 		})
 	}
 }
+
+func TestParseJobWeightAttribute(t *testing.T) {
+	tests := []struct {
+		attr string
+		want int
+	}{
+		{"V", 0},
+		{"J4", 4},
+		{"VJ12Q", 12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.attr, func(t *testing.T) {
+			ruleSet := parse(fmt.Sprintf("link:%s:\n\techo $target", tt.attr), "mkfile", "/mkfile", map[string][]string{})
+			rule := ruleSet.rules[0]
+			if rule.attributes.weight != tt.want {
+				t.Errorf("weight = %d, want %d", rule.attributes.weight, tt.want)
+			}
+			if tt.attr == "VJ12Q" && !(rule.attributes.virtual && rule.attributes.quiet) {
+				t.Errorf("attributes around J were not parsed: %+v", rule.attributes)
+			}
+		})
+	}
+}
+
+func TestParsePoolAttribute(t *testing.T) {
+	ruleSet := parse("link:VLlink:\n\techo $target", "mkfile", "/mkfile", map[string][]string{})
+	rule := ruleSet.rules[0]
+	if rule.attributes.pool != "link" {
+		t.Errorf("pool = %q, want %q", rule.attributes.pool, "link")
+	}
+	if !rule.attributes.virtual {
+		t.Errorf("attribute V before L was not parsed")
+	}
+}
+
+func TestParseTimeoutAttribute(t *testing.T) {
+	ruleSet := parse("test:VT1m30s:\n\techo $target", "mkfile", "/mkfile", map[string][]string{})
+	rule := ruleSet.rules[0]
+	if rule.attributes.timeout != 90*time.Second {
+		t.Errorf("timeout = %s, want %s", rule.attributes.timeout, 90*time.Second)
+	}
+}
+
+func TestParseRetryAttribute(t *testing.T) {
+	tests := []struct {
+		attr    string
+		retries int
+		backoff time.Duration
+	}{
+		{"A3", 3, 0},
+		{"VA2Q", 2, 0},
+		{"VA5/250ms", 5, 250 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.attr, func(t *testing.T) {
+			ruleSet := parse(fmt.Sprintf("fetch:%s:\n\techo $target", tt.attr), "mkfile", "/mkfile", map[string][]string{})
+			a := ruleSet.rules[0].attributes
+			if a.retries != tt.retries || a.backoff != tt.backoff {
+				t.Errorf("retries, backoff = %d, %s, want %d, %s", a.retries, a.backoff, tt.retries, tt.backoff)
+			}
+		})
+	}
+}
+
+func TestMetaIndexCandidates(t *testing.T) {
+	mkfile := `x.o:
+	:
+%.o: %.c
+	:
+lib/%: src/%
+	:
+(.*)\.c:R: \1.y
+	:
+lib/%.o a.out: %.s
+	:
+`
+	rs := parse(mkfile, "mkfile", "/mkfile", map[string][]string{})
+	tests := []struct {
+		name string
+		want []metaTarget
+	}{
+		{"x.o", []metaTarget{{1, 0}, {3, 0}}},
+		{"lib/x.o", []metaTarget{{1, 0}, {2, 0}, {3, 0}, {4, 0}}},
+		{"lib/", []metaTarget{{3, 0}}},
+		{"a.out", []metaTarget{{3, 0}, {4, 1}}},
+		{".o", []metaTarget{{3, 0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rs.meta.candidates(tt.name); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("candidates(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+// A generated mkfile: a metarule per directory, and files in each directory
+// for them to match, with some regular expression rules that never do.
+func manyMetarulesMkfile(dirs, files int) string {
+	var b strings.Builder
+	b.WriteString("all:V:")
+	for i := range dirs {
+		for j := range files {
+			fmt.Fprintf(&b, " d%d/f%d.o", i, j)
+		}
+	}
+	b.WriteString("\n")
+	for i := range dirs {
+		fmt.Fprintf(&b, "d%d/%%.o: d%d/%%.c\n\tcc -c -o $target $prereq\n", i, i)
+	}
+	for i := range 10 {
+		fmt.Fprintf(&b, "gen%d/(.*)\\.c:R: gen%d/\\1.in\n\tcp $prereq $target\n", i, i)
+	}
+	return b.String()
+}
+
+func BenchmarkBuildgraphMetarules(b *testing.B) {
+	rs := parse(manyMetarulesMkfile(1000, 10), "mkfile", "/mkfile", map[string][]string{})
+	opts, err := newBuildOpts(rs, Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for b.Loop() {
+		buildgraph(rs, []string{"all"}, opts)
+	}
+}
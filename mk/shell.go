@@ -0,0 +1,98 @@
+// Shells differ in how they receive list variables and quote words. As in
+// Plan 9 mk, recipes for rc get lists separated by \x01 in the environment,
+// so that elements containing spaces survive, while sh gets them separated
+// by spaces.
+
+package mk
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// The shell for recipes and backticks when the mkfile names none, and where
+// commands run.
+type shellConfig struct {
+	command  string // the shell, with its arguments (-shell)
+	keepArgs bool   // keep the arguments even when there are no others (-F)
+	dir      string // where commands run and files are found; "" for the working directory
+	norun    bool   // run no backticks or pipe includes, and read no includes
+}
+
+// The shell used when none is given.
+const defaultShell = "sh -e"
+
+// The conventions of a family of shells.
+type shellType struct {
+	name    string
+	sep     string              // separates list elements in the environment
+	errflag string              // makes the shell exit on the first failing command
+	quote   func(string) string // quote a word so the shell reads it as one; nil if values aren't quoted
+}
+
+var (
+	shellSh = &shellType{name: "sh", sep: " ", errflag: "-e"}
+	shellRc = &shellType{name: "rc", sep: "\x01", errflag: "-e", quote: quoteRc}
+
+	// Recipe interpreters that aren't shells, like awk or python.
+	shellOther = &shellType{name: "", sep: " "}
+)
+
+// Programs known to be Bourne-style shells.
+var shNames = []string{"sh", "bash", "dash", "ash", "ksh", "mksh", "zsh", "busybox"}
+
+// Return the type of a shell program.
+func shellTypeOf(program string) *shellType {
+	name := filepath.Base(program)
+	switch {
+	case name == "rc":
+		return shellRc
+	case slices.Contains(shNames, name):
+		return shellSh
+	}
+	return shellOther
+}
+
+// Return the shell named by the variables: $shell, or else Plan 9's $MKSHELL.
+func varsShell(vars map[string][]string) []string {
+	if len(vars["shell"]) > 0 {
+		return vars["shell"]
+	}
+	return vars["MKSHELL"]
+}
+
+// Quote a word for rc, if it contains special characters.
+func quoteRc(s string) string {
+	if s != "" && !strings.ContainsFunc(s, func(c rune) bool { return !isShellSafe(c) }) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// Characters that need no quoting in rc.
+func isShellSafe(c rune) bool {
+	return isalnum(c) || strings.ContainsRune("_@%+:,./-", c) || c > 127
+}
+
+// Join the elements of a list variable for the environment.
+func (st *shellType) join(v []string) string {
+	return strings.Join(v, st.sep)
+}
+
+// Expand the variables in a recipe. For rc, every element of a list is quoted
+// as needed so the list survives intact. Other shells get the elements joined
+// by spaces, unquoted, as recipes written for sh expect: they quote "$prereq"
+// themselves where a name may hold a space.
+func (st *shellType) expandRecipe(input string, vars map[string][]string) string {
+	return expandRecipeSigilsWith(input, vars, func(_ string, v []string) string {
+		if st.quote != nil {
+			quoted := make([]string, len(v))
+			for i := range v {
+				quoted[i] = st.quote(v[i])
+			}
+			return strings.Join(quoted, " ")
+		}
+		return strings.Join(v, " ")
+	})
+}
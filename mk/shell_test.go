@@ -0,0 +1,70 @@
+package mk
+
+import "testing"
+
+func TestShellTypeOf(t *testing.T) {
+	tests := []struct {
+		program string
+		want    *shellType
+	}{
+		{"sh", shellSh},
+		{"/bin/bash", shellSh},
+		{"rc", shellRc},
+		{"/usr/local/plan9/bin/rc", shellRc},
+		{"python3", shellOther},
+		{"awk", shellOther},
+	}
+	for _, tt := range tests {
+		if got := shellTypeOf(tt.program); got != tt.want {
+			t.Errorf("shellTypeOf(%q) = %q, want %q", tt.program, got.name, tt.want.name)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in, rc string
+	}{
+		{"plain.c", "plain.c"},
+		{"dir/a-b_c+d@e:f,g%h", "dir/a-b_c+d@e:f,g%h"},
+		{"my file", "'my file'"},
+		{"it's", "'it''s'"},
+		{"", "''"},
+		{"$x", "'$x'"},
+		{"*.c", "'*.c'"},
+	}
+	for _, tt := range tests {
+		if got := quoteRc(tt.in); got != tt.rc {
+			t.Errorf("quoteRc(%q) = %q, want %q", tt.in, got, tt.rc)
+		}
+	}
+}
+
+func TestShellExpandRecipe(t *testing.T) {
+	vars := map[string][]string{
+		"prereq":  {"a.c", "my file.c"},
+		"prereq2": {"my file.c"},
+		"CFLAGS":  {"-O2 -g"},
+		"items":   {"one", "two three"},
+	}
+	tests := []struct {
+		name  string
+		st    *shellType
+		input string
+		want  string
+	}{
+		{"sh_names", shellSh, "cc $CFLAGS $prereq", "cc -O2 -g a.c my file.c"},
+		{"sh_prereqN", shellSh, `cat "${prereq2}"`, `cat "my file.c"`},
+		{"sh_lists", shellSh, "echo $items", "echo one two three"},
+		{"rc_lists", shellRc, "echo $items $CFLAGS", "echo one 'two three' '-O2 -g'"},
+		{"rc_undefined", shellRc, "echo $undefined_in_test", "echo $undefined_in_test"},
+		{"other", shellOther, "print $prereq", "print a.c my file.c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.st.expandRecipe(tt.input, vars); got != tt.want {
+				t.Errorf("expandRecipe(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
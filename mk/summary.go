@@ -0,0 +1,93 @@
+// The summary printed at the end of a build with -summary, so that failures
+// aren't lost among the recipes' output: the targets that failed and why,
+// those skipped because of them, and the recipes that took longest.
+
+package mk
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// How many of the slowest recipes the summary lists.
+const summarySlowest = 5
+
+// Print a summary of the build of g.
+func printSummary(w io.Writer, g *Graph) {
+	var built, uptodate int
+	var failed, skipped, ran []*node
+	for _, n := range g.nodes {
+		if n == g.root {
+			continue
+		}
+		switch {
+		case n.status == nodeStatusDone && n.run != nil:
+			built++
+		case n.status == nodeStatusNop:
+			uptodate++
+		case n.status == nodeStatusFailed && n.run != nil:
+			failed = append(failed, n)
+		case n.status == nodeStatusFailed:
+			skipped = append(skipped, n)
+		}
+		if n.run != nil {
+			ran = append(ran, n)
+		}
+	}
+	byName := func(a, b *node) int { return strings.Compare(a.name, b.name) }
+	slices.SortFunc(failed, byName)
+	slices.SortFunc(skipped, byName)
+
+	fmt.Fprintf(w, "mk: %d built, %d up to date, %d failed, %d skipped\n",
+		built, uptodate, len(failed), len(skipped))
+	if len(failed) > 0 {
+		fmt.Fprintf(w, "mk: failed:\n")
+		for _, n := range failed {
+			fmt.Fprintf(w, "\t%s (%s:%d): %s\n", n.name, n.run.rule.file, n.run.rule.line, n.run.describe())
+		}
+	}
+	if len(skipped) > 0 {
+		fmt.Fprintf(w, "mk: skipped:\n")
+		for _, n := range skipped {
+			fmt.Fprintf(w, "\t%s: %s\n", n.name, skipReason(n))
+		}
+	}
+	if len(ran) > 0 {
+		slices.SortStableFunc(ran, func(a, b *node) int {
+			return cmp.Or(cmp.Compare(b.run.duration, a.run.duration), byName(a, b))
+		})
+		fmt.Fprintf(w, "mk: slowest recipes:\n")
+		for _, n := range ran[:min(len(ran), summarySlowest)] {
+			fmt.Fprintf(w, "\t%s\t%s\n", n.run.duration.Round(time.Millisecond), n.name)
+		}
+	}
+}
+
+// Describe how a recipe failed.
+func (r *recipeRun) describe() string {
+	switch r.status {
+	case "timeout":
+		return fmt.Sprintf("timed out after %s", r.timeout)
+	case "aborted":
+		return "aborted"
+	}
+	return fmt.Sprintf("exit status %d", r.exitCode)
+}
+
+// Explain why a failed node's recipe didn't run.
+func skipReason(n *node) string {
+	var names []string
+	for _, e := range n.prereqs {
+		if e.v != nil && e.v.status == nodeStatusFailed && !slices.Contains(names, e.v.name) {
+			names = append(names, e.v.name)
+		}
+	}
+	if len(names) == 0 {
+		return "another recipe failed"
+	}
+	return strings.Join(names, ", ") + " failed"
+}
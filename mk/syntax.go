@@ -0,0 +1,403 @@
+// The syntax tree of a mkfile: its statements as written, with their comments
+// and layout, before any variable is expanded or file included. Parse builds
+// one alongside the RuleSet, for tools that format or check mkfiles.
+//
+// The tree is lossless. Its statements, with the blank lines between them,
+// cover the whole of the source, so the text of each in turn reproduces the
+// mkfile exactly.
+
+package mk
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// A position in a mkfile.
+type Pos struct {
+	Offset int // in bytes, from 0
+	Line   int // from 1
+	Col    int // in runes, from 1
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
+}
+
+// A node of the syntax tree, spanning the source from Pos to End.
+type Node interface {
+	Pos() Pos
+	End() Pos
+}
+
+// Where a node is in the source.
+type span struct {
+	pos, end Pos
+}
+
+func (s span) Pos() Pos { return s.pos }
+func (s span) End() Pos { return s.end }
+
+// A statement of a mkfile, or what lies between statements. Statements are
+// whole lines: each begins at the start of a line and ends after a newline, or
+// at the end of the file.
+type Stmt interface {
+	Node
+	stmt()
+}
+
+// A mkfile as written.
+type File struct {
+	Name  string
+	Src   string
+	Stmts []Stmt // in order, covering all of Src
+}
+
+// Return the source text of a node.
+func (f *File) Text(n Node) string {
+	return f.Src[n.Pos().Offset:n.End().Offset]
+}
+
+// A word as written, with its quotes, variable references and backticks.
+type Word struct {
+	span
+	Text string
+}
+
+// Lines holding nothing but white space.
+type Blank struct {
+	span
+}
+
+// A comment, from # to the end of its line, or of the last line it is
+// continued onto.
+type Comment struct {
+	span
+	Text string
+}
+
+// An assignment: name=value, or name=U=value.
+type Assignment struct {
+	span
+	Name       Word
+	Unexported bool
+	Value      []Word
+	Comment    *Comment // at the end of the line, if any
+}
+
+// An include: < file, or <| command.
+type Include struct {
+	span
+	Pipe    bool
+	Args    []Word
+	Comment *Comment // at the end of the line, if any
+}
+
+// A rule, targets:attributes:prerequisites, and its recipe.
+type Rule struct {
+	span
+	Targets       []Word
+	HasAttributes bool // written with two colons
+	Attributes    []Word
+	Prereqs       []Word
+	Comment       *Comment // at the end of the header, if any
+	Recipe        *Recipe  // nil if it has none
+}
+
+// The recipe of a rule: its indented lines, as written.
+type Recipe struct {
+	span
+	Text string
+}
+
+// A statement with a syntax error in it, through the end of its line, and the
+// recipe following it, if any.
+type BadStmt struct {
+	span
+}
+
+func (*Blank) stmt()      {}
+func (*Comment) stmt()    {}
+func (*Assignment) stmt() {}
+func (*Include) stmt()    {}
+func (*Rule) stmt()       {}
+func (*BadStmt) stmt()    {}
+
+// Build the syntax tree of a mkfile. Its errors are left to the parser to
+// report; statements with errors in them are BadStmts.
+func ParseSyntax(input, name string) *File {
+	b := &syntaxBuilder{f: &File{Name: name, Src: input}, lines: []int{0}}
+	for i := range len(input) {
+		if input[i] == '\n' {
+			b.lines = append(b.lines, i+1)
+		}
+	}
+	_, tokens := lexFile(input, true)
+	for t := range tokens {
+		if t.typ == tokenError {
+			// The lexer gives up only at the end of the file.
+			b.truncated = true
+			for range tokens {
+			}
+			break
+		}
+		b.toks = append(b.toks, t)
+	}
+	b.build()
+	return b.f
+}
+
+// Builds a File from the tokens of a mkfile.
+type syntaxBuilder struct {
+	f         *File
+	lines     []int // offsets at which lines begin
+	toks      []token
+	i         int  // index of the next token
+	truncated bool // the lexer stopped at an error
+	stmts     []Stmt
+}
+
+// Return the position of a byte offset.
+func (b *syntaxBuilder) pos(off int) Pos {
+	off = min(off, len(b.f.Src))
+	line := sort.Search(len(b.lines), func(i int) bool { return b.lines[i] > off }) - 1
+	start := b.lines[line]
+	return Pos{Offset: off, Line: line + 1, Col: utf8.RuneCountInString(b.f.Src[start:off]) + 1}
+}
+
+// Return the offset at which the line holding off begins.
+func (b *syntaxBuilder) lineStart(off int) int {
+	return b.lines[b.pos(off).Line-1]
+}
+
+// Return the offset just past the newline ending the line holding off, or
+// the end of the source.
+func (b *syntaxBuilder) lineEnd(off int) int {
+	if off >= len(b.f.Src) {
+		return len(b.f.Src)
+	}
+	if i := strings.IndexByte(b.f.Src[off:], '\n'); i >= 0 {
+		return off + i + 1
+	}
+	return len(b.f.Src)
+}
+
+// Return the span of whole lines from the line holding from to the one
+// holding the last byte before to.
+func (b *syntaxBuilder) lineSpan(from, to int) span {
+	return span{b.pos(b.lineStart(from)), b.pos(b.lineEnd(max(from, to-1)))}
+}
+
+// Return the offset just past a token.
+func tokenEnd(t token) int {
+	return t.off + len(t.val)
+}
+
+// Group tokens into words: runs of tokens with no space between them, as
+// a:b or x=y in an assignment's value.
+func (b *syntaxBuilder) words(ts []token) []Word {
+	var words []Word
+	for i := 0; i < len(ts); {
+		j := i + 1
+		for j < len(ts) && ts[j].off == tokenEnd(ts[j-1]) {
+			j++
+		}
+		from, to := ts[i].off, tokenEnd(ts[j-1])
+		words = append(words, Word{span{b.pos(from), b.pos(to)}, b.f.Src[from:min(to, len(b.f.Src))]})
+		i = j
+	}
+	return words
+}
+
+// Return the rest of the tokens of the current line, up to but not including
+// its newline, and any comment ending it. The newline is consumed.
+func (b *syntaxBuilder) line() ([]token, *Comment, token, bool) {
+	var ts []token
+	var comment *Comment
+	for b.i < len(b.toks) {
+		t := b.toks[b.i]
+		b.i++
+		switch t.typ {
+		case tokenNewline:
+			return ts, comment, t, true
+		case tokenComment:
+			comment = &Comment{span{b.pos(t.off), b.pos(tokenEnd(t))}, t.val}
+		default:
+			ts = append(ts, t)
+		}
+	}
+	return ts, comment, token{}, false
+}
+
+// Build the file's statements.
+func (b *syntaxBuilder) build() {
+	for b.i < len(b.toks) {
+		t := b.toks[b.i]
+		switch t.typ {
+		case tokenNewline:
+			b.i++
+		case tokenComment:
+			b.i++
+			b.add(&Comment{b.lineSpan(t.off, tokenEnd(t)), t.val})
+		case tokenPipeInclude, tokenRedirInclude:
+			b.i++
+			ts, comment, nl, ok := b.line()
+			if !ok {
+				b.bad(t.off)
+				continue
+			}
+			if t.typ == tokenRedirInclude && !allWords(ts) {
+				b.skipRecipe()
+				b.add(&BadStmt{b.lineSpan(t.off, b.lastEnd(tokenEnd(nl)))})
+				continue
+			}
+			b.add(&Include{
+				span:    b.lineSpan(t.off, tokenEnd(nl)),
+				Pipe:    t.typ == tokenPipeInclude,
+				Args:    b.words(ts),
+				Comment: comment,
+			})
+		case tokenWord:
+			ts, comment, nl, ok := b.line()
+			if !ok {
+				b.bad(t.off)
+				continue
+			}
+			if s := b.statement(ts, comment, nl); s != nil {
+				b.add(s)
+			} else {
+				b.skipRecipe()
+				b.add(&BadStmt{b.lineSpan(t.off, b.lastEnd(tokenEnd(nl)))})
+			}
+		default:
+			b.i++
+			_, _, nl, ok := b.line()
+			if !ok {
+				b.bad(t.off)
+				continue
+			}
+			b.skipRecipe()
+			b.add(&BadStmt{b.lineSpan(t.off, b.lastEnd(tokenEnd(nl)))})
+		}
+	}
+	if b.truncated {
+		b.bad(len(b.f.Src))
+	}
+	b.fill()
+}
+
+// Make an assignment or a rule of the tokens of a line starting with a word,
+// or return nil if they are neither.
+func (b *syntaxBuilder) statement(ts []token, comment *Comment, nl token) Stmt {
+	if len(ts) >= 2 && (ts[1].typ == tokenAssign || ts[1].typ == tokenAssignU) {
+		return &Assignment{
+			span:       b.lineSpan(ts[0].off, tokenEnd(nl)),
+			Name:       b.words(ts[:1])[0],
+			Unexported: ts[1].typ == tokenAssignU,
+			Value:      b.words(ts[2:]),
+			Comment:    comment,
+		}
+	}
+
+	colon := -1
+	for i, t := range ts {
+		if t.typ == tokenColon {
+			colon = i
+			break
+		}
+		if t.typ != tokenWord {
+			return nil
+		}
+	}
+	if colon < 0 {
+		return nil
+	}
+	r := &Rule{Targets: b.words(ts[:colon]), Comment: comment}
+	rest := ts[colon+1:]
+	for i, t := range rest {
+		if t.typ == tokenColon {
+			r.HasAttributes = true
+			r.Attributes = b.words(rest[:i])
+			rest = rest[i+1:]
+			break
+		}
+	}
+	if !allWords(rest) {
+		return nil
+	}
+	r.Prereqs = b.words(rest)
+
+	end := tokenEnd(nl)
+	if b.i < len(b.toks) && b.toks[b.i].typ == tokenRecipe {
+		t := b.toks[b.i]
+		b.i++
+		// Blank lines after the recipe are not part of it.
+		text := strings.TrimRight(t.val, " \t\r\n")
+		r.Recipe = &Recipe{span: b.lineSpan(t.off, t.off+len(text))}
+		r.Recipe.Text = b.f.Text(r.Recipe)
+		end = r.Recipe.end.Offset
+	}
+	r.span = b.lineSpan(ts[0].off, end)
+	return r
+}
+
+// Report whether all the tokens are words.
+func allWords(ts []token) bool {
+	for _, t := range ts {
+		if t.typ != tokenWord {
+			return false
+		}
+	}
+	return true
+}
+
+// Skip the recipe following a bad statement, as the parser does.
+func (b *syntaxBuilder) skipRecipe() {
+	if b.i < len(b.toks) && b.toks[b.i].typ == tokenRecipe {
+		b.i++
+	}
+}
+
+// Return the end of the last token consumed, if it is a recipe skipped after
+// a bad statement, or else end.
+func (b *syntaxBuilder) lastEnd(end int) int {
+	if b.i > 0 && b.toks[b.i-1].typ == tokenRecipe {
+		return tokenEnd(b.toks[b.i-1])
+	}
+	return end
+}
+
+// Add a statement.
+func (b *syntaxBuilder) add(s Stmt) {
+	b.stmts = append(b.stmts, s)
+}
+
+// Add a bad statement from the line holding off to the end of the file.
+func (b *syntaxBuilder) bad(off int) {
+	b.i = len(b.toks)
+	from := b.lineStart(off)
+	if n := len(b.stmts); n > 0 {
+		from = max(from, b.stmts[n-1].End().Offset)
+	}
+	if from < len(b.f.Src) {
+		b.add(&BadStmt{span{b.pos(from), b.pos(len(b.f.Src))}})
+	}
+}
+
+// Fill the gaps between statements with blank lines, and set the file's
+// statements.
+func (b *syntaxBuilder) fill() {
+	last := 0
+	for _, s := range b.stmts {
+		if s.Pos().Offset > last {
+			b.f.Stmts = append(b.f.Stmts, &Blank{span{b.pos(last), s.Pos()}})
+		}
+		b.f.Stmts = append(b.f.Stmts, s)
+		last = s.End().Offset
+	}
+	if last < len(b.f.Src) {
+		b.f.Stmts = append(b.f.Stmts, &Blank{span{b.pos(last), b.pos(len(b.f.Src))}})
+	}
+}
@@ -0,0 +1,117 @@
+package mk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Check that the statements of a syntax tree cover its source, in order and
+// without overlapping, so that their texts reproduce it.
+func checkLossless(t *testing.T, f *File) {
+	t.Helper()
+	var b strings.Builder
+	for _, s := range f.Stmts {
+		if s.Pos().Offset != b.Len() {
+			t.Errorf("%s: %T at offset %d, want %d", f.Name, s, s.Pos().Offset, b.Len())
+			return
+		}
+		if s.Pos().Col != 1 {
+			t.Errorf("%s:%s: %T doesn't begin a line", f.Name, s.Pos(), s)
+		}
+		b.WriteString(f.Text(s))
+	}
+	if got := b.String(); got != f.Src {
+		t.Errorf("%s: statements reproduce\n%q\nwant\n%q", f.Name, got, f.Src)
+	}
+}
+
+func TestSyntaxLossless(t *testing.T) {
+	inputs := []string{
+		"",
+		"\n\n",
+		"a: b",
+		"# only a comment",
+		"X=1 # why\n\n\nall:V: a b # the default\n\techo $X\n\n\techo done\n\n# end\n",
+		"a:\\\n\tb c\n\techo a\n",
+		"a:\n# not the recipe\n\techo a\n",
+		"a b = c\n\techo skipped\nd: e\n",
+		"<|echo x=1\n< inc.mk\n",
+		"x: 'unterminated\n",
+		"a:\n\tx\n  \n",
+		"é=ü\nä: ö\n",
+	}
+	for _, in := range inputs {
+		checkLossless(t, ParseSyntax(in, "mkfile"))
+	}
+
+	// Every mkfile in the script tests, too.
+	paths, err := filepath.Glob("../testdata/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sec := range strings.Split(string(data), "\n-- ")[1:] {
+			name, body, _ := strings.Cut(sec, " --\n")
+			if strings.HasSuffix(name, "mkfile") || strings.HasSuffix(name, ".mk") {
+				checkLossless(t, ParseSyntax(body, path+":"+name))
+			}
+		}
+	}
+}
+
+func TestSyntaxStatements(t *testing.T) {
+	src := "# header\nCC=U=gcc -O2 # compiler\n\nall:V: a b\n\n%.o:Q: %.c\n\t$CC -c $stem.c\n\n\techo $stem\n\n< x.mk\n: bad\n\tskipped\n"
+	f := ParseSyntax(src, "mkfile")
+	checkLossless(t, f)
+
+	var kinds []string
+	for _, s := range f.Stmts {
+		kinds = append(kinds, strings.TrimPrefix(fmt.Sprintf("%T", s), "*mk."))
+	}
+	want := "Comment Assignment Blank Rule Blank Rule Blank Include BadStmt"
+	if got := strings.Join(kinds, " "); got != want {
+		t.Fatalf("statements are %s, want %s", got, want)
+	}
+
+	a := f.Stmts[1].(*Assignment)
+	if a.Name.Text != "CC" || !a.Unexported || len(a.Value) != 2 || a.Value[1].Text != "-O2" ||
+		a.Comment == nil || a.Comment.Text != "# compiler" {
+		t.Errorf("assignment is %+v", a)
+	}
+	if got, want := a.Value[0].Pos().String(), "2:6"; got != want {
+		t.Errorf("gcc is at %s, want %s", got, want)
+	}
+
+	r := f.Stmts[5].(*Rule)
+	if len(r.Targets) != 1 || r.Targets[0].Text != "%.o" || !r.HasAttributes ||
+		r.Attributes[0].Text != "Q" || r.Prereqs[0].Text != "%.c" {
+		t.Errorf("rule is %+v", r)
+	}
+	if r.Recipe == nil || r.Recipe.Text != "\t$CC -c $stem.c\n\n\techo $stem\n" {
+		t.Errorf("recipe is %+v", r.Recipe)
+	}
+	if got := f.Text(f.Stmts[8]); got != ": bad\n\tskipped\n" {
+		t.Errorf("bad statement is %q", got)
+	}
+}
+
+func TestParseSyntax(t *testing.T) {
+	rs, err := Parse("a: b # c\n", "mkfile", "/mkfile", ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := rs.Syntax()
+	if f == nil || len(f.Stmts) != 1 {
+		t.Fatalf("Syntax() = %+v, want one statement", f)
+	}
+	if r, ok := f.Stmts[0].(*Rule); !ok || r.Comment == nil {
+		t.Errorf("statement is %+v, want a commented rule", f.Stmts[0])
+	}
+}
@@ -0,0 +1,115 @@
+// A timeline of the build, written with -trace in the Chrome trace event
+// format, to be loaded in a trace viewer (chrome://tracing, or Perfetto). Each
+// job slot is a track, on which each recipe is a span; time a recipe spent
+// waiting for its pool and slots is an async span of its own.
+
+package mk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// An event in the Chrome trace event format.
+type traceEvent struct {
+	Name string         `json:"name"`
+	Cat  string         `json:"cat,omitempty"`
+	Ph   string         `json:"ph"`            // phase: X for a span, b and e for the ends of an async span, M for metadata
+	Ts   int64          `json:"ts"`            // microseconds since the build began
+	Dur  int64          `json:"dur,omitempty"` // microseconds
+	Pid  int            `json:"pid"`
+	Tid  int            `json:"tid"`
+	ID   int            `json:"id,omitempty"` // pairs the ends of an async span
+	Args map[string]any `json:"args,omitempty"`
+}
+
+// The track of waiting recipes. Slot tracks follow.
+const traceWaitTid = 0
+
+// A timeline being collected, written out when the build is over.
+type traceLog struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	start  time.Time
+	events []traceEvent
+	slots  []int // slots with a track
+	waits  int   // async spans so far
+}
+
+// Create a timeline to be written to w.
+func newTraceLog(w io.Writer) *traceLog {
+	return &traceLog{w: w, start: time.Now()}
+}
+
+// Microseconds from the start of the build to t.
+func (t *traceLog) ts(tm time.Time) int64 {
+	return tm.Sub(t.start).Microseconds()
+}
+
+// Record a recipe run from start to end, on each of the slots it held. Does
+// nothing if the log is nil.
+func (t *traceLog) recipe(target string, slots []int, start, end time.Time, status string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, slot := range slots {
+		if !slices.Contains(t.slots, slot) {
+			t.slots = append(t.slots, slot)
+		}
+		t.events = append(t.events, traceEvent{
+			Name: target,
+			Cat:  "recipe",
+			Ph:   "X",
+			Ts:   t.ts(start),
+			Dur:  t.ts(end) - t.ts(start),
+			Pid:  1,
+			Tid:  slot + 1,
+			Args: map[string]any{"status": status, "slots": slots},
+		})
+	}
+}
+
+// Record a recipe waiting from start to end for its pool and job slots. Does
+// nothing if the log is nil.
+func (t *traceLog) wait(target string, start, end time.Time, args map[string]any) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.waits++
+	name := "wait " + target
+	t.events = append(t.events,
+		traceEvent{Name: name, Cat: "wait", Ph: "b", Ts: t.ts(start), Pid: 1, Tid: traceWaitTid, ID: t.waits, Args: args},
+		traceEvent{Name: name, Cat: "wait", Ph: "e", Ts: t.ts(end), Pid: 1, Tid: traceWaitTid, ID: t.waits})
+}
+
+// Write the timeline. Does nothing if the log is nil.
+func (t *traceLog) finish() error {
+	if t == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	meta := []traceEvent{
+		{Name: "process_name", Ph: "M", Pid: 1, Args: map[string]any{"name": "mk"}},
+		{Name: "thread_name", Ph: "M", Pid: 1, Tid: traceWaitTid, Args: map[string]any{"name": "waiting"}},
+	}
+	slices.Sort(t.slots)
+	for _, slot := range t.slots {
+		meta = append(meta, traceEvent{
+			Name: "thread_name", Ph: "M", Pid: 1, Tid: slot + 1,
+			Args: map[string]any{"name": fmt.Sprintf("slot %d", slot)},
+		})
+	}
+	return json.NewEncoder(t.w).Encode(struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{append(meta, t.events...), "ms"})
+}
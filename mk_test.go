@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -34,25 +35,6 @@ func startMkWithStdin(stdin string, args ...string) ([]byte, []byte, error) {
 	return outbuffy.Bytes(), errbuffy.Bytes(), err
 }
 
-func TestMkPrintRecipeEmptyRecipe(t *testing.T) {
-	// Cover mkPrintRecipe with empty recipe and quiet=false.
-	// This path is effectively dead in normal execution (rules with empty recipes
-	// are filtered before reaching dorecipe), but exercise it for coverage.
-	// Note: this test must NOT use t.Parallel() since it swaps os.Stdout.
-	old := os.Stdout
-	r, w, _ := os.Pipe()
-	os.Stdout = w
-	mkPrintRecipe("target", "", false)
-	w.Close()
-	os.Stdout = old
-	var buf bytes.Buffer
-	buf.ReadFrom(r)
-	got := buf.String()
-	if want := "target: \n"; got != want {
-		t.Errorf("mkPrintRecipe empty recipe: got %q, want %q", got, want)
-	}
-}
-
 func TestInteractiveMode(t *testing.T) {
 	t.Parallel()
 	// Leading whitespace covers the whitespace-skip path in the interactive loop
@@ -94,19 +76,20 @@ func TestInteractiveModeEOF(t *testing.T) {
 	}
 }
 
-func TestMkNodeAlreadyClaimed(t *testing.T) {
-	// Calling mkNode on a node that's already been claimed (status != Ready/Nop)
-	// should return immediately without doing any work.
-	n := &node{
-		name:   "already-started",
-		status: nodeStatusStarted,
+func TestOpenEventLog(t *testing.T) {
+	for _, dest := range []string{"fd:", "fd:x", "fd:-1"} {
+		if _, err := openEventLog(dest); err == nil {
+			t.Errorf("openEventLog(%q) succeeded, want error", dest)
+		}
 	}
-	g := &graph{nodes: map[string]*node{n.name: n}}
-	mkNode(g, n, &buildOpts{dryrun: true}, false)
-	n.mutex.Lock()
-	got := n.status
-	n.mutex.Unlock()
-	if got != nodeStatusStarted {
-		t.Errorf("status changed to %v, expected it to remain nodeStatusStarted", got)
+
+	path := filepath.Join(t.TempDir(), "events.json")
+	w, err := openEventLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("openEventLog(%q) didn't create the file: %v", path, err)
 	}
 }
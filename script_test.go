@@ -29,6 +29,8 @@ func TestScript(t *testing.T) {
 
 	env := os.Environ()
 	env = append(env, "TEST_MAIN=mk")
+	// Recipes run mk recursively as $MK.
+	env = append(env, "MK="+testBin)
 
 	scripttest.Test(t, context.Background(), engine, env, "testdata/*.txt")
 }